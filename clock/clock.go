@@ -0,0 +1,19 @@
+// Package clock tells the time. Code that expires things takes a Clock so
+// tests can control the time instead of sleeping.
+package clock
+
+import "time"
+
+// Clock tells the time
+type Clock interface {
+	Now() time.Time
+}
+
+// System reads the system clock
+var System Clock = system{}
+
+type system struct{}
+
+func (system) Now() time.Time {
+	return time.Now()
+}
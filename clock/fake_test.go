@@ -0,0 +1,35 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFake(t *testing.T) {
+	Convey("Given a fake clock", t, func() {
+		start := time.Unix(1000, 0)
+		c := NewFake(start)
+
+		Convey("Then it should not move on its own", func() {
+			So(c.Now(), ShouldResemble, start)
+		})
+
+		Convey("When it is advanced", func() {
+			c.Advance(time.Minute)
+
+			Convey("Then the time should move forward", func() {
+				So(c.Now(), ShouldResemble, start.Add(time.Minute))
+			})
+		})
+
+		Convey("When it is set back", func() {
+			c.Set(start.Add(-time.Hour))
+
+			Convey("Then the time should move backwards", func() {
+				So(c.Now(), ShouldResemble, start.Add(-time.Hour))
+			})
+		})
+	})
+}
@@ -1,6 +1,9 @@
 package gossip
 
-import "github.com/hashicorp/memberlist"
+import (
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/metrics"
+	"github.com/hashicorp/memberlist"
+)
 
 type broadcast []byte
 
@@ -15,3 +18,17 @@ func (b broadcast) Message() []byte {
 func (b broadcast) Finished() {
 	// Finished
 }
+
+// QueueBroadcast queues a broadcast and records the queue length
+func (g *gossip) QueueBroadcast(b memberlist.Broadcast) {
+	g.TransmitLimitedQueue.QueueBroadcast(b)
+	g.metrics.Set(metrics.BroadcastQueue, float64(g.NumQueued()))
+}
+
+// GetBroadcasts returns broadcasts to piggyback on gossip messages and records
+// the queue length
+func (g *gossip) GetBroadcasts(overhead, limit int) [][]byte {
+	b := g.TransmitLimitedQueue.GetBroadcasts(overhead, limit)
+	g.metrics.Set(metrics.BroadcastQueue, float64(g.NumQueued()))
+	return b
+}
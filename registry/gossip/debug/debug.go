@@ -0,0 +1,157 @@
+// Package debug serves the internals of a gossip registry over HTTP.
+//
+// The handler can be mounted on any mux, for example:
+//
+//	mux.Handle("/debug/gossip/", http.StripPrefix("/debug/gossip", debug.NewHandler(r)))
+//
+// It serves the following endpoints:
+//
+//	GET  /members     members of the cluster and their status
+//	GET  /stats       health, queued broadcasts and the last push/pull
+//	GET  /watchers    open watchers and their queue depth
+//	GET  /state       the state with tombstones, see state.State.Export
+//	POST /clean       removes expired nodes from the state
+//	POST /deregister  removes the node given by the service, version and
+//	                  node form values
+package debug
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/ThatsMrTalbot/cluster/registry/gossip"
+)
+
+type handler struct {
+	r   gossip.Inspector
+	mux *http.ServeMux
+}
+
+// NewHandler creates a handler serving the internals of the registry, the
+// registry returned by gossip.New implements gossip.Inspector
+func NewHandler(r gossip.Inspector) http.Handler {
+	h := &handler{
+		r:   r,
+		mux: http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("/", h.index)
+	h.mux.HandleFunc("/members", h.get(h.members))
+	h.mux.HandleFunc("/stats", h.get(h.stats))
+	h.mux.HandleFunc("/watchers", h.get(h.watchers))
+	h.mux.HandleFunc("/state", h.get(h.state))
+	h.mux.HandleFunc("/clean", h.post(h.clean))
+	h.mux.HandleFunc("/deregister", h.post(h.deregister))
+
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Paths are matched relative to wherever the handler is mounted
+	if !strings.HasPrefix(r.URL.Path, "/") {
+		r.URL.Path = "/" + r.URL.Path
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *handler) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, []string{
+		"/members",
+		"/stats",
+		"/watchers",
+		"/state",
+		"/clean",
+		"/deregister",
+	})
+}
+
+func (h *handler) members(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.r.Members())
+}
+
+func (h *handler) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.r.Stats())
+}
+
+func (h *handler) watchers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.r.Watchers())
+}
+
+func (h *handler) state(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := h.r.Export(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handler) clean(w http.ResponseWriter, r *http.Request) {
+	if err := h.r.Clean(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) deregister(w http.ResponseWriter, r *http.Request) {
+	service := r.FormValue("service")
+	version := r.FormValue("version")
+	node := r.FormValue("node")
+
+	if service == "" || node == "" {
+		http.Error(w, "service and node are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.r.DeregisterNode(service, version, node); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// get only allows GET and HEAD requests
+func (h *handler) get(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		f(w, r)
+	}
+}
+
+// post only allows POST requests, so state is not changed by crawlers or
+// prefetching
+func (h *handler) post(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		f(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	byt, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(byt, '\n'))
+}
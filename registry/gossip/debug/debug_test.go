@@ -0,0 +1,174 @@
+package debug
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ThatsMrTalbot/cluster/registry/gossip"
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/state"
+	"github.com/facebookgo/freeport"
+	"github.com/micro/go-micro/registry"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHandler(t *testing.T) {
+	Convey("Given a registry with a service", t, func() {
+		port, err := freeport.Get()
+		So(err, ShouldBeNil)
+
+		addr := "127.0.0.1:" + strconv.Itoa(port)
+		r, err := gossip.New(
+			gossip.Address(addr),
+			gossip.Advertise(addr),
+			gossip.Logger(log.New(ioutil.Discard, "", log.LstdFlags)),
+			gossip.NetworkMode(gossip.Local),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			r.Close()
+		})
+
+		service := &registry.Service{
+			Name:    "test",
+			Version: "1.0.0",
+			Nodes: []*registry.Node{
+				{Id: "node", Address: "127.0.0.1", Port: 80},
+			},
+		}
+		So(r.Register(service), ShouldBeNil)
+
+		watcher, err := r.Watch()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			watcher.Stop()
+		})
+
+		server := httptest.NewServer(http.StripPrefix("/debug", NewHandler(r.(gossip.Inspector))))
+
+		Reset(func() {
+			server.Close()
+		})
+
+		Convey("When the members are requested", func() {
+			var members []gossip.Member
+			status := getJSON(server.URL+"/debug/members", &members)
+
+			Convey("Then the local member should be alive", func() {
+				So(status, ShouldEqual, http.StatusOK)
+				So(members, ShouldHaveLength, 1)
+				So(members[0].Local, ShouldBeTrue)
+				So(members[0].Status, ShouldEqual, gossip.MemberAlive)
+				So(members[0].Address, ShouldEqual, addr)
+			})
+		})
+
+		Convey("When the stats are requested", func() {
+			var stats gossip.Stats
+			status := getJSON(server.URL+"/debug/stats", &stats)
+
+			Convey("Then they should be returned", func() {
+				So(status, ShouldEqual, http.StatusOK)
+				So(stats.LastPushPull.IsZero(), ShouldBeTrue)
+			})
+		})
+
+		Convey("When the watchers are requested", func() {
+			var watchers []state.WatchStats
+			status := getJSON(server.URL+"/debug/watchers", &watchers)
+
+			Convey("Then the open watcher should be returned", func() {
+				So(status, ShouldEqual, http.StatusOK)
+				So(watchers, ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("When the state is requested", func() {
+			var doc struct {
+				Services []struct {
+					Name  string `json:"name"`
+					Nodes []struct {
+						Id      string `json:"id"`
+						Enabled bool   `json:"enabled"`
+					} `json:"nodes"`
+				} `json:"services"`
+			}
+			status := getJSON(server.URL+"/debug/state", &doc)
+
+			Convey("Then the service should be returned", func() {
+				So(status, ShouldEqual, http.StatusOK)
+				So(doc.Services, ShouldHaveLength, 1)
+				So(doc.Services[0].Name, ShouldEqual, "test")
+				So(doc.Services[0].Nodes, ShouldHaveLength, 1)
+				So(doc.Services[0].Nodes[0].Enabled, ShouldBeTrue)
+			})
+		})
+
+		Convey("When a clean is forced", func() {
+			resp, err := http.Post(server.URL+"/debug/clean", "", nil)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			Convey("Then it should succeed", func() {
+				So(resp.StatusCode, ShouldEqual, http.StatusNoContent)
+			})
+		})
+
+		Convey("When a clean is requested with GET", func() {
+			status := getJSON(server.URL+"/debug/clean", nil)
+
+			Convey("Then it should not be allowed", func() {
+				So(status, ShouldEqual, http.StatusMethodNotAllowed)
+			})
+		})
+
+		Convey("When the node is force deregistered", func() {
+			resp, err := http.PostForm(server.URL+"/debug/deregister", url.Values{
+				"service": {"test"},
+				"version": {"1.0.0"},
+				"node":    {"node"},
+			})
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			Convey("Then the service should be removed", func() {
+				So(resp.StatusCode, ShouldEqual, http.StatusNoContent)
+
+				_, err := r.GetService("test")
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When a deregister is missing the node", func() {
+			resp, err := http.Post(server.URL+"/debug/deregister", "application/x-www-form-urlencoded", strings.NewReader("service=test"))
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			Convey("Then it should be rejected", func() {
+				So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+				_, err := r.GetService("test")
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}
+
+func getJSON(url string, v interface{}) int {
+	resp, err := http.Get(url)
+	So(err, ShouldBeNil)
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && v != nil {
+		So(json.NewDecoder(resp.Body).Decode(v), ShouldBeNil)
+	}
+	return resp.StatusCode
+}
@@ -0,0 +1,32 @@
+package gossip
+
+import "fmt"
+
+// OptionError is returned by New when an option could not be applied
+type OptionError struct {
+	Option string
+	Err    error
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("Error applying option %s: %s", e.Option, e.Err)
+}
+
+// Cause returns the underlying error
+func (e *OptionError) Cause() error {
+	return e.Err
+}
+
+// MemberlistError is returned by New when the memberlist could not be created
+type MemberlistError struct {
+	Err error
+}
+
+func (e *MemberlistError) Error() string {
+	return fmt.Sprintf("Error creating memberlist: %s", e.Err)
+}
+
+// Cause returns the underlying error
+func (e *MemberlistError) Cause() error {
+	return e.Err
+}
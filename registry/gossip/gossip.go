@@ -3,7 +3,11 @@ package gossip
 import (
 	"log"
 	"os"
+	"sync"
+	"time"
 
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/logger"
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/metrics"
 	"github.com/ThatsMrTalbot/cluster/registry/gossip/state"
 	"github.com/hashicorp/memberlist"
 	"github.com/micro/go-micro/registry"
@@ -12,12 +16,45 @@ import (
 	"golang.org/x/net/context"
 )
 
+// Registry is a gossip registry that can leave the cluster
+type Registry interface {
+	registry.Registry
+
+	// Leave deregisters all locally registered services and leaves the
+	// cluster, the context deadline is used as the leave timeout. Calls
+	// after the registry has left do nothing
+	Leave(ctx context.Context) error
+
+	// WatchWith creates a watcher whose results are filtered by the options,
+	// Watch is the same as WatchWith without options
+	WatchWith(opts ...state.WatchOption) (registry.Watcher, error)
+
+	// Close leaves the cluster and shuts down the registry
+	Close() error
+}
+
 type gossip struct {
 	*state.State
 	*memberlist.TransmitLimitedQueue
 
-	m *memberlist.Memberlist
-	l *log.Logger
+	m        *memberlist.Memberlist
+	keyring  *memberlist.Keyring
+	keys     keyRequests
+	name     string
+	log      logger.Logger
+	mu       sync.Mutex
+	local    localServices
+	members  members
+	metrics  metrics.Metrics
+	pushPull pushPull
+	once     sync.Once
+	done     chan struct{}
+	left     bool
+
+	leaveTimeout     time.Duration
+	registerInterval time.Duration
+	digestSync       bool
+	snapshotPath     string
 }
 
 func (g *gossip) NodeMeta(int) []byte {
@@ -25,51 +62,262 @@ func (g *gossip) NodeMeta(int) []byte {
 }
 
 func (g *gossip) NotifyMsg(buf []byte) {
-	err := g.State.MergeRemote(buf)
+	if len(buf) != 0 && buf[0] == keyMessagePrefix {
+		g.handleKeyMessage(buf[1:])
+		return
+	}
+
+	diff, err := g.State.MergeRemoteAndReturnDiff(buf)
 	if err != nil {
-		g.l.Printf("[ERROR] Error merging broadcast: %s", err)
+		g.log.Log(logger.ErrorLevel, "Error merging broadcast", logger.Fields{"error": err})
 	}
+
+	g.reassert(diff)
 }
 
 func (g *gossip) LocalState(join bool) []byte {
+	// Joins always exchange the full state so new members, and members that
+	// do not understand digests, are brought up to date in one round trip
+	if !join && g.digestSync {
+		byt, err := g.State.LocalDigest(g.name)
+		if err != nil {
+			g.log.Log(logger.ErrorLevel, "Error getting local digest", logger.Fields{"error": err})
+		}
+		g.metrics.Set(metrics.LocalDigestBytes, float64(len(byt)))
+		return byt
+	}
+
 	byt, err := g.State.LocalState()
 	if err != nil {
-		g.l.Printf("[ERROR] Error getting local state: %s", err)
+		g.log.Log(logger.ErrorLevel, "Error getting local state", logger.Fields{"error": err})
 	}
+	g.metrics.Set(metrics.LocalStateBytes, float64(len(byt)))
 	return byt
 }
 
 func (g *gossip) MergeRemoteState(buf []byte, join bool) {
-	err := g.State.MergeRemote(buf)
+	g.pushPull.Mark()
+
+	if digest, ok := state.ParseDigest(buf); ok {
+		go g.sendDelta(digest)
+		return
+	}
+
+	diff, err := g.State.MergeRemoteAndReturnDiff(buf)
 	if err != nil {
-		g.l.Printf("[ERROR] Error merging remote state: %s", err)
+		g.log.Log(logger.ErrorLevel, "Error merging remote state", logger.Fields{"join": join, "error": err})
+	}
+
+	g.reassert(diff)
+}
+
+// sendDelta sends the services that differ from the digest to the member that
+// sent it
+func (g *gossip) sendDelta(digest *state.Digest) {
+	delta, err := g.State.Delta(digest)
+	if err != nil {
+		g.log.Log(logger.ErrorLevel, "Error getting delta", logger.Fields{"member": digest.From, "error": err})
+		return
+	}
+
+	if delta == nil {
+		return
+	}
+
+	for _, node := range g.m.Members() {
+		if node.Name != digest.From {
+			continue
+		}
+
+		if err := g.m.SendReliable(node, delta); err != nil {
+			g.log.Log(logger.ErrorLevel, "Error sending delta", logger.Fields{"member": node.Name, "error": err})
+		}
+		return
 	}
 }
 
 func (g *gossip) Deregister(s *registry.Service) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
 	change, err := g.DeregisterAndReturnChange(s)
 	if err != nil {
 		return errors.Wrap(err, "Error deregistering service")
 	}
 
+	g.local.Remove(s)
+
 	// Broadcast change
 	g.QueueBroadcast(broadcast(change))
 	return nil
 }
 
 func (g *gossip) Register(s *registry.Service, ops ...registry.RegisterOption) error {
+	options := registry.RegisterOptions{
+		Context: context.TODO(),
+	}
+
+	for _, o := range ops {
+		o(&options)
+	}
+
+	// The service would expire between re-registrations
+	if g.registerInterval > 0 && options.TTL > 0 && g.registerInterval >= options.TTL {
+		return errors.Errorf("Register interval %s must be less than the TTL %s", g.registerInterval, options.TTL)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
 	change, err := g.RegisterAndReturnChange(s, ops...)
 	if err != nil {
 		return errors.Wrap(err, "Error registering service")
 	}
 
+	g.local.Add(s, options.TTL)
+
 	// Broadcast change
 	g.QueueBroadcast(broadcast(change))
 	return nil
 }
 
-// NewRegistry creates a new registry
-func NewRegistry(opts ...registry.Option) registry.Registry {
+// minLeaveTimeout is the shortest time Leave waits for the leave message to be
+// broadcast, memberlist waits forever if the timeout is not positive
+const minLeaveTimeout = 10 * time.Millisecond
+
+func (g *gossip) Leave(ctx context.Context) error {
+	changes, left, err := g.deregisterLocal()
+	if left {
+		return nil
+	}
+
+	// The lock is not held while sending, message handlers take it to
+	// reassert local services
+	for _, change := range changes {
+		// Push the change to members directly so they do not have to wait
+		// for the broadcast to propagate
+		if e := g.sendToMembers(ctx, change); e != nil && err == nil {
+			err = errors.Wrap(e, "Error sending deregistration")
+		}
+	}
+
+	timeout := g.leaveTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = deadline.Sub(time.Now())
+	}
+	if timeout < minLeaveTimeout {
+		timeout = minLeaveTimeout
+	}
+
+	if e := g.m.Leave(timeout); e != nil && err == nil {
+		err = errors.Wrap(e, "Error leaving memberlist")
+	}
+	return err
+}
+
+// deregisterLocal marks the registry as left and deregisters all local
+// services, the changes are broadcast and returned so they can be sent to
+// members directly. Left is true if the registry had already left
+func (g *gossip) deregisterLocal() (changes [][]byte, left bool, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.left {
+		return nil, true, nil
+	}
+	g.left = true
+
+	// Keep going on errors so the remaining services are deregistered and
+	// the memberlist is left, the first error is returned
+	for _, l := range g.local.List() {
+		change, e := g.DeregisterAndReturnChange(l.Service)
+		if e != nil {
+			if err == nil {
+				err = errors.Wrap(e, "Error deregistering service")
+			}
+			continue
+		}
+
+		g.local.Remove(l.Service)
+		g.QueueBroadcast(broadcast(change))
+		changes = append(changes, change)
+	}
+
+	return changes, false, err
+}
+
+func (g *gossip) Close() error {
+	var err error
+	g.once.Do(func() {
+		close(g.done)
+
+		// Write the state before leaving removes the local services
+		if g.snapshotPath != "" {
+			g.writeSnapshot(g.snapshotPath)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), g.leaveTimeout)
+		defer cancel()
+
+		err = g.Leave(ctx)
+
+		g.members.Stop()
+
+		if e := g.m.Shutdown(); e != nil && err == nil {
+			err = errors.Wrap(e, "Error shutting down memberlist")
+		}
+
+		g.State.Stop()
+	})
+	return err
+}
+
+func (g *gossip) join(addrs []string, retry joinRetry) {
+	wait := retry.Min
+	for {
+		_, err := g.m.Join(addrs)
+		if err == nil {
+			return
+		}
+
+		g.log.Log(logger.WarnLevel, "Error joining cluster, retrying", logger.Fields{"retry": wait, "error": err})
+
+		select {
+		case <-time.After(wait):
+		case <-g.done:
+			return
+		}
+
+		wait *= 2
+		if wait > retry.Max {
+			wait = retry.Max
+		}
+	}
+}
+
+func (g *gossip) sendToMembers(ctx context.Context, msg []byte) error {
+	for _, node := range g.m.Members() {
+		if node.Name == g.name {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if err := g.m.SendReliable(node, msg); err != nil {
+			g.log.Log(logger.ErrorLevel, "Error sending message", logger.Fields{"member": node.Name, "error": err})
+		}
+	}
+	return nil
+}
+
+// New creates a new gossip registry. Seed addresses are joined in the
+// background, failed joins are retried with backoff until one succeeds or the
+// registry is closed
+func New(opts ...registry.Option) (Registry, error) {
 	options := &registry.Options{
 		Context: context.TODO(),
 	}
@@ -82,43 +330,106 @@ func NewRegistry(opts ...registry.Option) registry.Registry {
 	config := getMemberlistConfig(options)
 	config.Name = hostname + "-" + uuid.NewUUID().String()
 
-	log := applyLogger(options, config)
+	applyTuning(options, config)
+
+	l := applyLogger(options, config)
 
 	if err := applySecretKey(options, config); err != nil {
-		log.Fatalf("Error creating memberlist: %s", err)
+		return nil, &OptionError{Option: "SecretKey", Err: err}
 	}
 
 	if err := applyAddress(options, config); err != nil {
-		log.Fatalf("Error creating memberlist: %s", err)
+		return nil, &OptionError{Option: "Address", Err: err}
 	}
 
 	if err := applyAdvertise(options, config); err != nil {
-		log.Fatalf("Error creating memberlist: %s", err)
+		return nil, &OptionError{Option: "Advertise", Err: err}
+	}
+
+	retry := getJoinRetry(options)
+	if err := validateJoinRetry(retry); err != nil {
+		return nil, &OptionError{Option: "JoinRetry", Err: err}
+	}
+
+	applyMemberlistConfig(options, config)
+
+	if err := validateMemberlistConfig(config); err != nil {
+		return nil, &OptionError{Option: "MemberlistConfig", Err: err}
+	}
+
+	// All traffic goes over TLS when a TLS config is given, so broadcasts
+	// are only accepted from peers with a verified certificate
+	if options.TLSConfig != nil {
+		if config.Transport != nil {
+			return nil, &OptionError{Option: "TLSConfig", Err: errors.New("TLS cannot be used with a custom transport")}
+		}
+
+		t, err := newTLSTransport(config.BindAddr, config.BindPort, options.TLSConfig, l)
+		if err != nil {
+			return nil, &OptionError{Option: "TLSConfig", Err: err}
+		}
+		config.Transport = t
+	}
+
+	g := &gossip{
+		log:              l,
+		name:             config.Name,
+		done:             make(chan struct{}),
+		leaveTimeout:     getLeaveTimeout(options),
+		registerInterval: getRegisterInterval(options),
+		digestSync:       getDigestSync(options),
+		snapshotPath:     getSnapshotPath(options),
+		metrics:          getMetrics(options),
+		keyring:          config.Keyring,
+		State:            state.NewState(getCleanInterval(options), append(getStateOptions(options), state.Owner(config.Name))...),
 	}
 
-	g := new(gossip)
+	g.members.grace = getMemberGracePeriod(options)
+
+	if g.snapshotPath != "" {
+		g.loadSnapshot(g.snapshotPath, getSnapshotStale(options))
+	}
 
 	config.Delegate = g
+	config.Events = g
 
 	m, err := memberlist.Create(config)
 	if err != nil {
-		log.Fatalf("Error creating memberlist: %s", err)
+		if config.Transport != nil {
+			config.Transport.Shutdown()
+		}
+		g.State.Stop()
+		return nil, &MemberlistError{Err: err}
 	}
 
 	g.m = m
-	g.l = log
-	g.State = state.NewState(ExpiryTick)
 	g.TransmitLimitedQueue = &memberlist.TransmitLimitedQueue{
 		NumNodes:       m.NumMembers,
-		RetransmitMult: 3,
+		RetransmitMult: config.RetransmitMult,
 	}
 
 	if len(options.Addrs) != 0 {
-		_, err := m.Join(options.Addrs)
-		if err != nil {
-			log.Fatalf("Error creating memberlist: %s", err)
-		}
+		go g.join(options.Addrs, retry)
+	}
+
+	if g.registerInterval > 0 {
+		go g.heartbeat(g.registerInterval)
 	}
 
+	if g.snapshotPath != "" {
+		go g.snapshot(g.snapshotPath, getSnapshotInterval(options))
+	}
+
+	return g, nil
+}
+
+// NewRegistry creates a new registry, the returned registry implements
+// Registry. The process exits if the registry cannot be created, use New to
+// handle the error instead
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	g, err := New(opts...)
+	if err != nil {
+		log.Fatalf("Error creating registry: %s", err)
+	}
 	return g
 }
@@ -5,13 +5,19 @@ import (
 	"io/ioutil"
 	"log"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/ThatsMrTalbot/cluster/clock"
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/metrics"
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/state"
 	"github.com/facebookgo/freeport"
+	"github.com/hashicorp/memberlist"
 	"github.com/micro/go-micro/registry"
 	"github.com/pborman/uuid"
 	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/context"
 )
 
 func TestRegistry(t *testing.T) {
@@ -72,30 +78,539 @@ func TestRegistry(t *testing.T) {
 				So(service[0].Nodes, ShouldHaveLength, 1)
 			}))
 		}))
+
+		Convey("When a joined registry leaves", WithRegistry([]string{r1Address}, func(r2 registry.Registry, addr string, port int) {
+			WithService(r2, "test", addr, port, nil)()
+			time.Sleep(time.Second * 1)
+
+			service, err := r1.GetService("test")
+			So(err, ShouldBeNil)
+			So(service, ShouldHaveLength, 1)
+
+			err = r2.(Registry).Leave(context.TODO())
+			So(err, ShouldBeNil)
+
+			Convey("Then its services should be removed without waiting for expiry", func() {
+				time.Sleep(time.Millisecond * 100)
+
+				service, err := r1.GetService("test")
+				So(err, ShouldNotBeNil)
+				So(service, ShouldHaveLength, 0)
+			})
+
+			Convey("Then leaving again or closing should do nothing", func() {
+				So(r2.(Registry).Leave(context.TODO()), ShouldBeNil)
+				So(r2.(Registry).Close(), ShouldBeNil)
+			})
+		}))
+
+		Convey("When a joined registry leaves after the context is cancelled", WithRegistry([]string{r1Address}, func(r2 registry.Registry, addr string, port int) {
+			WithService(r2, "test", addr, port, nil)()
+			WithService(r2, "other", addr, port, nil)()
+			time.Sleep(time.Second * 1)
+
+			ctx, cancel := context.WithCancel(context.TODO())
+			cancel()
+
+			err := r2.(Registry).Leave(ctx)
+
+			Convey("Then an error should be returned", func() {
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Then all of its services should still be deregistered", func() {
+				time.Sleep(time.Millisecond * 100)
+
+				list, err := r1.ListServices()
+				So(err, ShouldBeNil)
+				So(list, ShouldHaveLength, 0)
+			})
+		}))
+
+		Convey("When a joined registry leaves after the context deadline has passed", WithRegistry([]string{r1Address}, func(r2 registry.Registry, addr string, port int) {
+			WithService(r2, "test", addr, port, nil)()
+			time.Sleep(time.Second * 1)
+
+			ctx, cancel := context.WithDeadline(context.TODO(), time.Now().Add(-time.Second))
+			defer cancel()
+
+			start := time.Now()
+			err := r2.(Registry).Leave(ctx)
+
+			Convey("Then it should return without waiting for the leave to be broadcast", func() {
+				So(err, ShouldNotBeNil)
+				So(time.Since(start), ShouldBeLessThan, time.Second)
+			})
+		}))
+	}))
+}
+
+func TestMembers(t *testing.T) {
+	Convey("Given a gossip registry", t, WithRegistry(nil, func(r1 registry.Registry, addr string, port int) {
+		r1Address := fmt.Sprintf("%s:%d", addr, port)
+
+		Convey("When a joined registry registers a service", WithRegistry([]string{r1Address}, func(r2 registry.Registry, addr string, port int) {
+			WithService(r2, "test", addr, port, nil)()
+			time.Sleep(time.Second * 1)
+
+			member := &memberlist.Node{Name: r2.(*gossip).name}
+
+			Convey("Then its nodes should be disabled once it dies", func() {
+				r1.(*gossip).NotifyLeave(member)
+				time.Sleep(time.Millisecond * 200)
+
+				service, err := r1.GetService("test")
+				So(err, ShouldNotBeNil)
+				So(service, ShouldHaveLength, 0)
+			})
+
+			Convey("Then it should be reported as leaving until the grace period passes", func() {
+				r1.(*gossip).NotifyLeave(member)
+
+				members := r1.(Inspector).Members()
+				So(members, ShouldHaveLength, 2)
+				for _, m := range members {
+					if m.Name == member.Name {
+						So(m.Status, ShouldEqual, MemberLeaving)
+					} else {
+						So(m.Status, ShouldEqual, MemberAlive)
+					}
+				}
+			})
+
+			Convey("Then it should be reported as alive if it rejoins within the grace period", func() {
+				r1.(*gossip).NotifyLeave(member)
+				r1.(*gossip).NotifyJoin(member)
+
+				members := r1.(Inspector).Members()
+				So(members, ShouldHaveLength, 2)
+				for _, m := range members {
+					So(m.Status, ShouldEqual, MemberAlive)
+				}
+			})
+
+			Convey("Then its nodes should be kept if it rejoins within the grace period", func() {
+				r1.(*gossip).NotifyLeave(member)
+				r1.(*gossip).NotifyJoin(member)
+				time.Sleep(time.Millisecond * 200)
+
+				service, err := r1.GetService("test")
+				So(err, ShouldBeNil)
+				So(service, ShouldHaveLength, 1)
+			})
+		}))
+	}, MemberGracePeriod(time.Millisecond*100)))
+
+	Convey("Given a gossip registry with a service", t, WithRegistry(nil, func(r1 registry.Registry, addr string, port int) {
+		WithService(r1, "test", addr, port, nil)()
+
+		Convey("When another member disables its nodes", func() {
+			local, err := r1.(*gossip).State.LocalState()
+			So(err, ShouldBeNil)
+
+			other := state.NewState(0, state.Owner("other"))
+			defer other.Stop()
+
+			So(other.MergeRemote(local), ShouldBeNil)
+			So(other.DisableOwner(r1.(*gossip).name), ShouldBeNil)
+
+			disabled, err := other.LocalState()
+			So(err, ShouldBeNil)
+
+			r1.(*gossip).NotifyMsg(disabled)
+
+			Convey("Then the service should be registered again", func() {
+				service, err := r1.GetService("test")
+				So(err, ShouldBeNil)
+				So(service, ShouldHaveLength, 1)
+				So(service[0].Nodes, ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("When the service is deregistered and a member sends an old copy", func() {
+			local, err := r1.(*gossip).State.LocalState()
+			So(err, ShouldBeNil)
+
+			services, err := r1.GetService("test")
+			So(err, ShouldBeNil)
+			So(r1.Deregister(services[0]), ShouldBeNil)
+
+			r1.(*gossip).NotifyMsg(local)
+
+			Convey("Then the service should stay deregistered", func() {
+				_, err := r1.GetService("test")
+				So(err, ShouldNotBeNil)
+			})
+		})
+	}))
+}
+
+func TestDeregisterNode(t *testing.T) {
+	Convey("Given a gossip registry", t, WithRegistry(nil, func(r1 registry.Registry, addr string, port int) {
+		r1Address := fmt.Sprintf("%s:%d", addr, port)
+
+		Convey("When a node of a service with metadata is deregistered", WithService(r1, "test", addr, port, func(service *registry.Service) {
+			extra := *service
+			extra.Metadata = map[string]string{"key": "value"}
+			extra.Endpoints = []*registry.Endpoint{{Name: "Test.Call"}}
+			extra.Nodes = []*registry.Node{{Id: uuid.NewUUID().String(), Address: addr, Port: port}}
+			So(r1.Register(&extra), ShouldBeNil)
+
+			err := r1.(Inspector).DeregisterNode("test", "1.0.0", extra.Nodes[0].Id)
+			So(err, ShouldBeNil)
+
+			Convey("Then the other nodes, metadata and endpoints should be kept", func() {
+				services, err := r1.GetService("test")
+				So(err, ShouldBeNil)
+				So(services, ShouldHaveLength, 1)
+				So(services[0].Nodes, ShouldHaveLength, 1)
+				So(services[0].Nodes[0].Id, ShouldEqual, service.Nodes[0].Id)
+				So(services[0].Metadata, ShouldResemble, extra.Metadata)
+				So(services[0].Endpoints, ShouldHaveLength, 1)
+			})
+		}))
+
+		Convey("When an unknown node is deregistered", WithService(r1, "test", addr, port, func(*registry.Service) {
+			err := r1.(Inspector).DeregisterNode("test", "1.0.0", "unknown")
+
+			Convey("Then an error should be returned", func() {
+				So(err, ShouldNotBeNil)
+			})
+		}))
+
+		Convey("When another member deregisters a node of a live owner", WithRegistry([]string{r1Address}, func(r2 registry.Registry, _ string, _ int) {
+			WithService(r1, "test", addr, port, func(service *registry.Service) {
+				time.Sleep(time.Second * 1)
+
+				err := r2.(Inspector).DeregisterNode("test", "1.0.0", service.Nodes[0].Id)
+				So(err, ShouldBeNil)
+
+				Convey("Then the owner should register it again", func() {
+					time.Sleep(time.Second * 1)
+
+					services, err := r2.GetService("test")
+					So(err, ShouldBeNil)
+					So(services, ShouldHaveLength, 1)
+					So(services[0].Nodes, ShouldHaveLength, 1)
+				})
+			})()
+		}))
 	}))
 }
 
-func WithRegistry(addrs []string, f func(registry.Registry, string, int)) func() {
+func TestRegisterInterval(t *testing.T) {
+	c := clock.NewFake(time.Unix(1000, 0))
+
+	Convey("Given a gossip registry with a register interval", t, WithRegistry(nil, func(r1 registry.Registry, addr string, port int) {
+		Convey("When a service is registered with a TTL", WithService(r1, "test", addr, port, func(service *registry.Service) {
+			Convey("Then the service should not expire", func() {
+				c.Advance(time.Minute * 2)
+				time.Sleep(time.Millisecond * 200)
+
+				So(r1.(*gossip).Clean(), ShouldBeNil)
+
+				service, err := r1.GetService("test")
+				So(err, ShouldBeNil)
+				So(service, ShouldHaveLength, 1)
+			})
+
+			Convey("Then the service should stay gone once deregistered", func() {
+				So(r1.Deregister(service), ShouldBeNil)
+
+				c.Advance(time.Minute * 2)
+				time.Sleep(time.Millisecond * 200)
+
+				So(r1.(*gossip).Clean(), ShouldBeNil)
+
+				_, err := r1.GetService("test")
+				So(err, ShouldNotBeNil)
+				So(r1.(*gossip).local.List(), ShouldBeEmpty)
+			})
+		}, registry.RegisterTTL(time.Minute)))
+
+		Convey("When a service is registered with a TTL no longer than the interval", func() {
+			service := &registry.Service{
+				Name: "test",
+				Nodes: []*registry.Node{
+					{
+						Id:      uuid.NewUUID().String(),
+						Address: addr,
+						Port:    port,
+					},
+				},
+			}
+
+			err := r1.Register(service, registry.RegisterTTL(time.Millisecond*50))
+
+			Convey("Then an error should be returned", func() {
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Then the service should not be registered", func() {
+				_, err := r1.GetService("test")
+				So(err, ShouldNotBeNil)
+				So(r1.(*gossip).local.List(), ShouldBeEmpty)
+			})
+		})
+	}, RegisterInterval(time.Millisecond*50), CleanInterval(0), Clock(c)))
+
+	Convey("Given a gossip registry without a register interval", t, WithRegistry(nil, func(r1 registry.Registry, addr string, port int) {
+		Convey("When a service is registered with a TTL", WithService(r1, "test", addr, port, func(service *registry.Service) {
+			c.Advance(time.Minute * 2)
+
+			Convey("Then the service should be kept until cleaned", func() {
+				_, err := r1.GetService("test")
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Then the service should expire", func() {
+				So(r1.(*gossip).Clean(), ShouldBeNil)
+
+				_, err := r1.GetService("test")
+				So(err, ShouldNotBeNil)
+			})
+		}, registry.RegisterTTL(time.Minute)))
+	}, CleanInterval(0), Clock(c)))
+}
+
+func TestCleanInterval(t *testing.T) {
+	c := clock.NewFake(time.Unix(1000, 0))
+
+	Convey("Given a gossip registry with a clean interval", t, WithRegistry(nil, func(r1 registry.Registry, addr string, port int) {
+		Convey("When a service with a TTL expires", WithService(r1, "test", addr, port, func(service *registry.Service) {
+			c.Advance(time.Minute * 2)
+
+			Convey("Then it should be cleaned on the interval", func() {
+				time.Sleep(time.Millisecond * 200)
+
+				_, err := r1.GetService("test")
+				So(err, ShouldNotBeNil)
+			})
+		}, registry.RegisterTTL(time.Minute)))
+	}, CleanInterval(time.Millisecond*50), Clock(c)))
+}
+
+func TestDigestSync(t *testing.T) {
+	Convey("Given a registry with the default options", t, WithRegistry(nil, func(r registry.Registry, _ string, _ int) {
+		Convey("Then periodic syncs should send the full state", func() {
+			_, ok := state.ParseDigest(r.(*gossip).LocalState(false))
+			So(ok, ShouldBeFalse)
+		})
+	}))
+
+	m := &gauges{values: make(map[string]float64)}
+
+	Convey("Given a registry with digest sync enabled", t, WithRegistry(nil, func(r registry.Registry, _ string, _ int) {
+		Convey("Then periodic syncs should send a digest", func() {
+			_, ok := state.ParseDigest(r.(*gossip).LocalState(false))
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Then joins should send the full state", func() {
+			_, ok := state.ParseDigest(r.(*gossip).LocalState(true))
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Then digest and full state sizes should be recorded separately", func() {
+			digest := r.(*gossip).LocalState(false)
+			full := r.(*gossip).LocalState(true)
+
+			So(m.Value(metrics.LocalDigestBytes), ShouldEqual, len(digest))
+			So(m.Value(metrics.LocalStateBytes), ShouldEqual, len(full))
+		})
+	}, DigestSync(true), Metrics(m)))
+}
+
+// gauges records the last value set for each metric
+type gauges struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (g *gauges) Add(string, float64)     {}
+func (g *gauges) Observe(string, float64) {}
+
+func (g *gauges) Set(name string, value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.values[name] = value
+}
+
+func (g *gauges) Value(name string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.values[name]
+}
+
+func TestNew(t *testing.T) {
+	Convey("Given registry options", t, func() {
+		logger := Logger(log.New(ioutil.Discard, "", log.LstdFlags))
+
+		Convey("When the bind address is invalid", func() {
+			_, err := New(logger, Address("invalid"))
+
+			Convey("Then an option error should be returned", func() {
+				So(err, ShouldHaveSameTypeAs, &OptionError{})
+				So(err.(*OptionError).Option, ShouldEqual, "Address")
+			})
+		})
+
+		Convey("When the seed addresses are unreachable", func() {
+			portInt, err := freeport.Get()
+			So(err, ShouldBeNil)
+
+			reg, err := New(
+				logger,
+				Address("127.0.0.1:0"),
+				NetworkMode(Local),
+				JoinRetry(time.Millisecond*10, time.Millisecond*100),
+				registry.Addrs("127.0.0.1:"+strconv.Itoa(portInt)),
+			)
+
+			Convey("Then the registry should still be created", func() {
+				So(err, ShouldBeNil)
+				So(reg.Close(), ShouldBeNil)
+			})
+
+			Convey("Then it should join once a peer appears", func() {
+				So(err, ShouldBeNil)
+				defer reg.Close()
+
+				peer, err := New(logger, Address("127.0.0.1:"+strconv.Itoa(portInt)), NetworkMode(Local))
+				So(err, ShouldBeNil)
+				defer peer.Close()
+
+				time.Sleep(time.Millisecond * 500)
+
+				So(reg.(Inspector).Members(), ShouldHaveLength, 2)
+				So(peer.(Inspector).Members(), ShouldHaveLength, 2)
+			})
+		})
+
+		Convey("When the minimum join retry is not positive", func() {
+			_, err := New(logger, Address("127.0.0.1:0"), JoinRetry(0, time.Second))
+
+			Convey("Then an option error should be returned", func() {
+				So(err, ShouldHaveSameTypeAs, &OptionError{})
+				So(err.(*OptionError).Option, ShouldEqual, "JoinRetry")
+			})
+		})
+
+		Convey("When the maximum join retry is less than the minimum", func() {
+			_, err := New(logger, Address("127.0.0.1:0"), JoinRetry(time.Second, time.Millisecond))
+
+			Convey("Then an option error should be returned", func() {
+				So(err, ShouldHaveSameTypeAs, &OptionError{})
+				So(err.(*OptionError).Option, ShouldEqual, "JoinRetry")
+			})
+		})
+
+		Convey("When the memberlist is tuned", func() {
+			var config *memberlist.Config
+
+			reg, err := New(
+				logger,
+				Address("127.0.0.1:0"),
+				NetworkMode(Local),
+				ProbeInterval(time.Second*2),
+				ProbeTimeout(time.Second),
+				SuspicionMult(5),
+				GossipNodes(2),
+				GossipInterval(time.Millisecond*50),
+				PushPullInterval(time.Second*5),
+				RetransmitMult(6),
+				MemberlistConfig(func(c *memberlist.Config) {
+					c.IndirectChecks = 2
+					config = c
+				}),
+			)
+			So(err, ShouldBeNil)
+
+			Reset(func() {
+				reg.Close()
+			})
+
+			Convey("Then the settings should be applied before the hook runs", func() {
+				So(config.ProbeInterval, ShouldEqual, time.Second*2)
+				So(config.ProbeTimeout, ShouldEqual, time.Second)
+				So(config.SuspicionMult, ShouldEqual, 5)
+				So(config.GossipNodes, ShouldEqual, 2)
+				So(config.GossipInterval, ShouldEqual, time.Millisecond*50)
+				So(config.PushPullInterval, ShouldEqual, time.Second*5)
+				So(config.RetransmitMult, ShouldEqual, 6)
+				So(config.IndirectChecks, ShouldEqual, 2)
+				So(reg.(*gossip).TransmitLimitedQueue.RetransmitMult, ShouldEqual, 6)
+			})
+		})
+
+		Convey("When the probe timeout is not less than the probe interval", func() {
+			_, err := New(logger, Address("127.0.0.1:0"), ProbeInterval(time.Second), ProbeTimeout(time.Second))
+
+			Convey("Then an option error should be returned", func() {
+				So(err, ShouldHaveSameTypeAs, &OptionError{})
+				So(err.(*OptionError).Option, ShouldEqual, "MemberlistConfig")
+			})
+		})
+
+		Convey("When the hook sets an invalid config", func() {
+			_, err := New(logger, Address("127.0.0.1:0"), MemberlistConfig(func(c *memberlist.Config) {
+				c.SuspicionMult = 0
+			}))
+
+			Convey("Then an option error should be returned", func() {
+				So(err, ShouldHaveSameTypeAs, &OptionError{})
+				So(err.(*OptionError).Option, ShouldEqual, "MemberlistConfig")
+			})
+		})
+
+		Convey("When the hook changes the retransmit multiplier", func() {
+			reg, err := New(logger, Address("127.0.0.1:0"), NetworkMode(Local), RetransmitMult(6), MemberlistConfig(func(c *memberlist.Config) {
+				c.RetransmitMult = 8
+			}))
+			So(err, ShouldBeNil)
+
+			Reset(func() {
+				reg.Close()
+			})
+
+			Convey("Then registry broadcasts should use it", func() {
+				So(reg.(*gossip).TransmitLimitedQueue.RetransmitMult, ShouldEqual, 8)
+			})
+		})
+
+		Convey("When the retransmit multiplier is zero", func() {
+			_, err := New(logger, Address("127.0.0.1:0"), RetransmitMult(0))
+
+			Convey("Then an option error should be returned", func() {
+				So(err, ShouldHaveSameTypeAs, &OptionError{})
+				So(err.(*OptionError).Option, ShouldEqual, "MemberlistConfig")
+			})
+		})
+	})
+}
+
+func WithRegistry(addrs []string, f func(registry.Registry, string, int), opts ...registry.Option) func() {
 	return func() {
 		portInt, err := freeport.Get()
 		So(err, ShouldBeNil)
 
 		port := strconv.Itoa(portInt)
 
-		reg := NewRegistry(
-			Address("127.0.0.1:"+port),
-			Advertise("127.0.0.1:"+port),
+		reg, err := New(append([]registry.Option{
+			Address("127.0.0.1:" + port),
+			Advertise("127.0.0.1:" + port),
 			Logger(log.New(ioutil.Discard, "", log.LstdFlags)),
 			NetworkMode(Local),
 			SecretKey([]byte("SixteenBytTstKey")),
 			registry.Addrs(addrs...),
 			registry.Secure(true),
-		)
+		}, opts...)...)
+		So(err, ShouldBeNil)
 
 		Reset(func() {
-			m := reg.(*gossip).m
-			m.Leave(time.Second * 10)
-			m.Shutdown()
+			reg.Close()
 		})
 
 		if f != nil {
@@ -104,7 +619,7 @@ func WithRegistry(addrs []string, f func(registry.Registry, string, int)) func()
 	}
 }
 
-func WithService(reg registry.Registry, name string, addr string, port int, f func(*registry.Service)) func() {
+func WithService(reg registry.Registry, name string, addr string, port int, f func(*registry.Service), opts ...registry.RegisterOption) func() {
 	return func() {
 		service := &registry.Service{
 			Name:     name,
@@ -120,7 +635,7 @@ func WithService(reg registry.Registry, name string, addr string, port int, f fu
 			},
 		}
 
-		err := reg.Register(service)
+		err := reg.Register(service, opts...)
 		So(err, ShouldBeNil)
 
 		Reset(func() {
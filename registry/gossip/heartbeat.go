@@ -0,0 +1,47 @@
+package gossip
+
+import (
+	"time"
+
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/logger"
+	"github.com/micro/go-micro/registry"
+)
+
+// heartbeat refreshes local services until the registry is closed
+func (g *gossip) heartbeat(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.refresh()
+		case <-g.done:
+			return
+		}
+	}
+}
+
+// refresh registers local services with a TTL again so they get a fresh expiry
+func (g *gossip) refresh() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, l := range g.local.List() {
+		if l.TTL != 0 {
+			g.register(l)
+		}
+	}
+}
+
+// register registers a local service again and broadcasts the change, the
+// registry lock must be held
+func (g *gossip) register(l localService) {
+	change, err := g.RegisterAndReturnChange(l.Service, registry.RegisterTTL(l.TTL))
+	if err != nil {
+		g.log.Log(logger.ErrorLevel, "Error registering service", logger.Fields{"service": l.Service.Name, "error": err})
+		return
+	}
+
+	g.QueueBroadcast(broadcast(change))
+}
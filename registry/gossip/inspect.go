@@ -0,0 +1,166 @@
+package gossip
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/state"
+	"github.com/micro/go-micro/registry"
+	"github.com/pkg/errors"
+)
+
+// Member statuses
+const (
+	// MemberAlive is a member memberlist has not declared dead. memberlist
+	// does not expose whether it suspects a member, so suspect members are
+	// reported alive until they are declared dead and start leaving
+	MemberAlive = "alive"
+
+	// MemberLeaving is a member that left or died whose nodes are disabled
+	// once the grace period has passed
+	MemberLeaving = "leaving"
+)
+
+// Inspector exposes the internals of a gossip registry for debugging, the
+// registry returned by New implements it
+type Inspector interface {
+	Registry
+
+	// Members returns the members of the cluster as seen by this member
+	Members() []Member
+
+	// Stats returns the gossip stats of this member
+	Stats() Stats
+
+	// Export writes the state, including tombstones, as JSON
+	Export(w io.Writer) error
+
+	// Watchers returns the delivery stats of all open watchers
+	Watchers() []state.WatchStats
+
+	// Clean removes expired nodes from the state
+	Clean() error
+
+	// DeregisterNode removes a node from the state and broadcasts the
+	// removal. A live owner on another member registers the node again as
+	// soon as it receives the removal, a node registered through this
+	// registry is deregistered as it would be by Deregister
+	DeregisterNode(service string, version string, id string) error
+}
+
+// Member is a member of the cluster
+type Member struct {
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+	Local   bool   `json:"local"`
+	Status  string `json:"status"`
+}
+
+// Stats are the gossip stats of a member
+type Stats struct {
+	// Health is the memberlist awareness score, lower is healthier
+	Health int `json:"health"`
+
+	// QueuedBroadcasts is the number of broadcasts waiting to be sent
+	QueuedBroadcasts int `json:"queuedBroadcasts"`
+
+	// LastPushPull is the time a remote state was last received, zero if
+	// none has been
+	LastPushPull time.Time `json:"lastPushPull"`
+}
+
+// pushPull records the time of the last push/pull
+type pushPull struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (p *pushPull) Mark() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.last = time.Now()
+}
+
+func (p *pushPull) Last() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.last
+}
+
+func (g *gossip) Members() []Member {
+	leaving := make(map[string]bool)
+	for _, name := range g.members.Leaving() {
+		leaving[name] = true
+	}
+
+	var members []Member
+	for _, node := range g.m.Members() {
+		// Members that died are reported once, as leaving, even if
+		// memberlist has not dropped them yet
+		if leaving[node.Name] {
+			continue
+		}
+
+		members = append(members, Member{
+			Name:    node.Name,
+			Address: node.Addr.String() + ":" + strconv.Itoa(int(node.Port)),
+			Local:   node.Name == g.name,
+			Status:  MemberAlive,
+		})
+	}
+
+	for name := range leaving {
+		members = append(members, Member{
+			Name:   name,
+			Status: MemberLeaving,
+		})
+	}
+
+	sort.Sort(byName(members))
+	return members
+}
+
+func (g *gossip) Stats() Stats {
+	return Stats{
+		Health:           g.m.GetHealthScore(),
+		QueuedBroadcasts: g.NumQueued(),
+		LastPushPull:     g.pushPull.Last(),
+	}
+}
+
+func (g *gossip) DeregisterNode(service string, version string, id string) error {
+	if service == "" || id == "" {
+		return errors.New("Service name and node id are required")
+	}
+
+	services, err := g.GetService(service)
+	if err != nil {
+		return errors.Wrap(err, "Error getting service")
+	}
+
+	// Remove the stored service so its metadata and endpoints are kept
+	for _, s := range services {
+		if s.Version != version {
+			continue
+		}
+
+		if i, node := state.NodeByID(s.Nodes, id); i != -1 {
+			c := *s
+			c.Nodes = []*registry.Node{node}
+			return g.Deregister(&c)
+		}
+	}
+
+	return errors.Errorf("Node %s of service %s not found", id, service)
+}
+
+type byName []Member
+
+func (m byName) Len() int           { return len(m) }
+func (m byName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byName) Less(i, j int) bool { return m[i].Name < m[j].Name }
@@ -0,0 +1,270 @@
+package gossip
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/logger"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// keyMessagePrefix starts key messages, a marshaled state never starts with
+// it as zero is not a valid protobuf field number
+const keyMessagePrefix = 0
+
+// Key operations
+const (
+	keyInstall = "install"
+	keyUse     = "use"
+	keyRemove  = "remove"
+	keyAck     = "ack"
+)
+
+// ErrEncryptionDisabled is returned by key operations on a registry created
+// without registry.Secure
+var ErrEncryptionDisabled = errors.New("Encryption is not enabled")
+
+// KeyManager rotates the gossip encryption keys across the cluster, the
+// registry returned by New implements it. As with Serf, a key is rotated in
+// three steps that should each succeed on every member before the next: the
+// new key is installed, then used as the primary key, then the old key is
+// removed
+type KeyManager interface {
+	// InstallKey adds a key to every keyring, messages encrypted with it can
+	// then be decrypted
+	InstallKey(ctx context.Context, key []byte) (*KeyResponse, error)
+
+	// UseKey makes an installed key the primary key of every keyring, it is
+	// used to encrypt messages
+	UseKey(ctx context.Context, key []byte) (*KeyResponse, error)
+
+	// RemoveKey removes a key from every keyring, the primary key cannot be
+	// removed
+	RemoveKey(ctx context.Context, key []byte) (*KeyResponse, error)
+
+	// ListKeys returns the primary key and every installed key of this member
+	ListKeys() (primary []byte, keys [][]byte, err error)
+}
+
+// KeyResponse is the result of a key operation across the cluster
+type KeyResponse struct {
+	// Members is the number of other members the operation was sent to
+	Members int
+
+	// Errors holds the members that failed to apply the operation or did not
+	// respond before the context was done
+	Errors map[string]error
+}
+
+// keyMessage is a key operation or the acknowledgement of one
+type keyMessage struct {
+	ID    string `json:"id"`
+	Op    string `json:"op"`
+	From  string `json:"from"`
+	Key   []byte `json:"key,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// keyRequests tracks key operations waiting for acknowledgements
+type keyRequests struct {
+	mu      sync.Mutex
+	pending map[string]chan keyMessage
+}
+
+// Wait returns the channel acknowledgements for the operation are sent on
+func (k *keyRequests) Wait(id string, n int) chan keyMessage {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.pending == nil {
+		k.pending = make(map[string]chan keyMessage)
+	}
+
+	c := make(chan keyMessage, n)
+	k.pending[id] = c
+	return c
+}
+
+// Done stops waiting for acknowledgements
+func (k *keyRequests) Done(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.pending, id)
+}
+
+// Ack delivers an acknowledgement, it is dropped if nothing is waiting
+func (k *keyRequests) Ack(msg keyMessage) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	select {
+	case k.pending[msg.ID] <- msg:
+	default:
+	}
+}
+
+func (g *gossip) InstallKey(ctx context.Context, key []byte) (*KeyResponse, error) {
+	return g.keyOp(ctx, keyInstall, key)
+}
+
+func (g *gossip) UseKey(ctx context.Context, key []byte) (*KeyResponse, error) {
+	return g.keyOp(ctx, keyUse, key)
+}
+
+func (g *gossip) RemoveKey(ctx context.Context, key []byte) (*KeyResponse, error) {
+	return g.keyOp(ctx, keyRemove, key)
+}
+
+func (g *gossip) ListKeys() ([]byte, [][]byte, error) {
+	if g.keyring == nil {
+		return nil, nil, ErrEncryptionDisabled
+	}
+
+	return g.keyring.GetPrimaryKey(), g.keyring.GetKeys(), nil
+}
+
+// keyOp applies a key operation locally, then sends it to every other member
+// and waits for them to acknowledge it
+func (g *gossip) keyOp(ctx context.Context, op string, key []byte) (*KeyResponse, error) {
+	if g.keyring == nil {
+		return nil, ErrEncryptionDisabled
+	}
+
+	if err := g.applyKey(op, key); err != nil {
+		return nil, errors.Wrapf(err, "Error applying key %s", op)
+	}
+
+	msg := keyMessage{
+		ID:   uuid.NewUUID().String(),
+		Op:   op,
+		From: g.name,
+		Key:  key,
+	}
+
+	buf, err := encodeKeyMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	members := g.m.Members()
+	acks := g.keys.Wait(msg.ID, len(members))
+	defer g.keys.Done(msg.ID)
+
+	resp := &KeyResponse{
+		Errors: make(map[string]error),
+	}
+
+	pending := make(map[string]bool)
+	for _, node := range members {
+		if node.Name == g.name {
+			continue
+		}
+
+		resp.Members++
+		if err := g.m.SendReliable(node, buf); err != nil {
+			resp.Errors[node.Name] = errors.Wrap(err, "Error sending key operation")
+			continue
+		}
+		pending[node.Name] = true
+	}
+
+	for len(pending) != 0 {
+		select {
+		case ack := <-acks:
+			if !pending[ack.From] {
+				continue
+			}
+
+			delete(pending, ack.From)
+			if ack.Error != "" {
+				resp.Errors[ack.From] = errors.New(ack.Error)
+			}
+		case <-ctx.Done():
+			for name := range pending {
+				resp.Errors[name] = errors.Wrap(ctx.Err(), "No response to key operation")
+			}
+			pending = nil
+		}
+	}
+
+	if len(resp.Errors) != 0 {
+		return resp, errors.Errorf("Error applying key %s on %d of %d members", op, len(resp.Errors), resp.Members)
+	}
+	return resp, nil
+}
+
+// applyKey applies a key operation to the local keyring
+func (g *gossip) applyKey(op string, key []byte) error {
+	switch op {
+	case keyInstall:
+		return g.keyring.AddKey(key)
+	case keyUse:
+		return g.keyring.UseKey(key)
+	case keyRemove:
+		return g.keyring.RemoveKey(key)
+	}
+	return errors.Errorf("Unknown key operation `%s`", op)
+}
+
+// handleKeyMessage applies a key operation sent by another member and
+// acknowledges it, or delivers an acknowledgement
+func (g *gossip) handleKeyMessage(buf []byte) {
+	var msg keyMessage
+	if err := json.Unmarshal(buf, &msg); err != nil {
+		g.log.Log(logger.ErrorLevel, "Error decoding key message", logger.Fields{"error": err})
+		return
+	}
+
+	if msg.Op == keyAck {
+		g.keys.Ack(msg)
+		return
+	}
+
+	ack := keyMessage{
+		ID:   msg.ID,
+		Op:   keyAck,
+		From: g.name,
+	}
+
+	if g.keyring == nil {
+		ack.Error = ErrEncryptionDisabled.Error()
+	} else if err := g.applyKey(msg.Op, msg.Key); err != nil {
+		ack.Error = err.Error()
+	}
+
+	g.log.Log(logger.InfoLevel, "Applied key operation", logger.Fields{"member": msg.From, "op": msg.Op, "error": ack.Error})
+
+	// Memberlist handles messages one at a time, so do not block it on the
+	// reply
+	go g.sendKeyAck(msg.From, ack)
+}
+
+func (g *gossip) sendKeyAck(to string, ack keyMessage) {
+	buf, err := encodeKeyMessage(ack)
+	if err != nil {
+		g.log.Log(logger.ErrorLevel, "Error encoding key acknowledgement", logger.Fields{"error": err})
+		return
+	}
+
+	for _, node := range g.m.Members() {
+		if node.Name != to {
+			continue
+		}
+
+		if err := g.m.SendReliable(node, buf); err != nil {
+			g.log.Log(logger.ErrorLevel, "Error sending key acknowledgement", logger.Fields{"member": to, "error": err})
+		}
+		return
+	}
+}
+
+func encodeKeyMessage(msg keyMessage) ([]byte, error) {
+	byt, err := json.Marshal(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error encoding key message")
+	}
+	return append([]byte{keyMessagePrefix}, byt...), nil
+}
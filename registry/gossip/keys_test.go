@@ -0,0 +1,162 @@
+package gossip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/registry"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/context"
+)
+
+func TestKeyRotation(t *testing.T) {
+	oldKey := []byte("SixteenBytTstKey")
+	newKey := []byte("SixteenBytNewKey")
+
+	Convey("Given two joined registries sharing a key", t, WithRegistry(nil, func(r1 registry.Registry, addr string, port int) {
+		r1Address := fmt.Sprintf("%s:%d", addr, port)
+
+		WithRegistry([]string{r1Address}, func(r2 registry.Registry, addr string, port int) {
+			time.Sleep(time.Millisecond * 500)
+
+			k1, k2 := r1.(KeyManager), r2.(KeyManager)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			Reset(cancel)
+
+			Convey("When a new key is installed", func() {
+				resp, err := k1.InstallKey(ctx, newKey)
+				So(err, ShouldBeNil)
+				So(resp.Members, ShouldEqual, 1)
+
+				Convey("Then both members should have both keys", func() {
+					for _, k := range []KeyManager{k1, k2} {
+						primary, keys, err := k.ListKeys()
+						So(err, ShouldBeNil)
+						So(primary, ShouldResemble, oldKey)
+						So(keys, ShouldHaveLength, 2)
+					}
+				})
+
+				Convey("And it is used and the old key removed", func() {
+					_, err := k1.UseKey(ctx, newKey)
+					So(err, ShouldBeNil)
+
+					_, err = k1.RemoveKey(ctx, oldKey)
+					So(err, ShouldBeNil)
+
+					Convey("Then both members should only have the new key", func() {
+						for _, k := range []KeyManager{k1, k2} {
+							primary, keys, err := k.ListKeys()
+							So(err, ShouldBeNil)
+							So(primary, ShouldResemble, newKey)
+							So(keys, ShouldResemble, [][]byte{newKey})
+						}
+					})
+
+					Convey("Then services should still propagate", WithService(r2, "test", addr, port, func(*registry.Service) {
+						time.Sleep(time.Second)
+
+						service, err := r1.GetService("test")
+						So(err, ShouldBeNil)
+						So(service, ShouldHaveLength, 1)
+					}))
+				})
+			})
+
+			Convey("When a key that is not installed is used", func() {
+				_, err := k1.UseKey(ctx, newKey)
+
+				Convey("Then it should fail", func() {
+					So(err, ShouldNotBeNil)
+
+					primary, _, err := k2.ListKeys()
+					So(err, ShouldBeNil)
+					So(primary, ShouldResemble, oldKey)
+				})
+			})
+
+			Convey("When the primary key is removed", func() {
+				_, err := k1.RemoveKey(ctx, oldKey)
+
+				Convey("Then it should fail", func() {
+					So(err, ShouldNotBeNil)
+				})
+			})
+		})()
+	}))
+}
+
+func TestSecretKeys(t *testing.T) {
+	Convey("Given registry options", t, func() {
+		logger := Logger(log.New(ioutil.Discard, "", log.LstdFlags))
+
+		Convey("When secure mode is enabled without a key", func() {
+			_, err := New(logger, Address("127.0.0.1:0"), registry.Secure(true))
+
+			Convey("Then an option error should be returned", func() {
+				So(err, ShouldHaveSameTypeAs, &OptionError{})
+				So(err.(*OptionError).Option, ShouldEqual, "SecretKey")
+			})
+		})
+
+		Convey("When secure mode is enabled with the default key allowed", func() {
+			reg, err := New(logger, Address("127.0.0.1:0"), registry.Secure(true), AllowDefaultKey(true))
+			So(err, ShouldBeNil)
+
+			Reset(func() {
+				reg.Close()
+			})
+
+			Convey("Then the default key should be used", func() {
+				primary, _, err := reg.(KeyManager).ListKeys()
+				So(err, ShouldBeNil)
+				So(primary, ShouldResemble, DefaultKey)
+			})
+		})
+
+		Convey("When several keys are set", func() {
+			primaryKey := []byte("SixteenBytTstKey")
+			otherKey := []byte("SixteenBytOldKey")
+
+			reg, err := New(logger, Address("127.0.0.1:0"), registry.Secure(true), SecretKeys(primaryKey, otherKey))
+			So(err, ShouldBeNil)
+
+			Reset(func() {
+				reg.Close()
+			})
+
+			Convey("Then every key should be installed", func() {
+				primary, keys, err := reg.(KeyManager).ListKeys()
+				So(err, ShouldBeNil)
+				So(primary, ShouldResemble, primaryKey)
+				So(keys, ShouldHaveLength, 2)
+			})
+		})
+
+		Convey("When a key has an invalid length", func() {
+			_, err := New(logger, Address("127.0.0.1:0"), registry.Secure(true), SecretKey([]byte("short")))
+
+			Convey("Then an option error should be returned", func() {
+				So(err, ShouldHaveSameTypeAs, &OptionError{})
+			})
+		})
+
+		Convey("When secure mode is disabled", func() {
+			reg, err := New(logger, Address("127.0.0.1:0"))
+			So(err, ShouldBeNil)
+
+			Reset(func() {
+				reg.Close()
+			})
+
+			Convey("Then key operations should fail", func() {
+				_, err := reg.(KeyManager).InstallKey(context.TODO(), []byte("SixteenBytTstKey"))
+				So(err, ShouldEqual, ErrEncryptionDisabled)
+			})
+		})
+	})
+}
@@ -0,0 +1,122 @@
+package gossip
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/state"
+	"github.com/micro/go-micro/registry"
+)
+
+// localService is a service registered through this registry
+type localService struct {
+	Service *registry.Service
+	TTL     time.Duration
+}
+
+// localServices tracks the services registered through this registry
+type localServices struct {
+	mu       sync.Mutex
+	services map[string]*localService
+}
+
+func serviceKey(s *registry.Service) string {
+	return s.Name + "/" + s.Version
+}
+
+func copyService(s *registry.Service) *registry.Service {
+	c := *s
+	c.Nodes = make([]*registry.Node, len(s.Nodes))
+	copy(c.Nodes, s.Nodes)
+	return &c
+}
+
+// Add records the service and its nodes as locally owned
+func (l *localServices) Add(s *registry.Service, ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.services == nil {
+		l.services = make(map[string]*localService)
+	}
+
+	key := serviceKey(s)
+	existing, ok := l.services[key]
+	if !ok {
+		l.services[key] = &localService{
+			Service: copyService(s),
+			TTL:     ttl,
+		}
+		return
+	}
+
+	nodes := existing.Service.Nodes
+	for _, node := range s.Nodes {
+		if i, _ := state.NodeByID(nodes, node.Id); i != -1 {
+			nodes[i] = node
+		} else {
+			nodes = append(nodes, node)
+		}
+	}
+
+	existing.Service = copyService(s)
+	existing.Service.Nodes = nodes
+	existing.TTL = ttl
+}
+
+// Remove forgets the nodes of the service
+func (l *localServices) Remove(s *registry.Service) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := serviceKey(s)
+	existing, ok := l.services[key]
+	if !ok {
+		return
+	}
+
+	nodes := make([]*registry.Node, 0, len(existing.Service.Nodes))
+	for _, node := range existing.Service.Nodes {
+		if i, _ := state.NodeByID(s.Nodes, node.Id); i == -1 {
+			nodes = append(nodes, node)
+		}
+	}
+
+	if len(nodes) == 0 {
+		delete(l.services, key)
+		return
+	}
+
+	existing.Service.Nodes = nodes
+}
+
+// Get returns a copy of a locally owned service
+func (l *localServices) Get(name string, version string) (localService, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, ok := l.services[name+"/"+version]
+	if !ok {
+		return localService{}, false
+	}
+
+	return localService{
+		Service: copyService(s.Service),
+		TTL:     s.TTL,
+	}, true
+}
+
+// List returns copies of all locally owned services
+func (l *localServices) List() []localService {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	services := make([]localService, 0, len(l.services))
+	for _, s := range l.services {
+		services = append(services, localService{
+			Service: copyService(s.Service),
+			TTL:     s.TTL,
+		})
+	}
+	return services
+}
@@ -0,0 +1,165 @@
+// Package logger defines the leveled structured logger used by the gossip
+// registry, with an adapter for the standard library logger. See the logrus
+// package for a logrus adapter.
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// Log levels
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "DEBUG"
+	case InfoLevel:
+		return "INFO"
+	case WarnLevel:
+		return "WARN"
+	case ErrorLevel:
+		return "ERROR"
+	}
+	return "Level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// Fields are the key/value pairs of a log entry
+type Fields map[string]interface{}
+
+// Logger is a leveled structured logger, fields may be nil
+type Logger interface {
+	Log(level Level, msg string, fields Fields)
+}
+
+// Nop discards all entries
+var Nop Logger = nop{}
+
+type nop struct{}
+
+func (nop) Log(Level, string, Fields) {}
+
+type filter struct {
+	l   Logger
+	min Level
+}
+
+// Filter drops entries below the minimum level
+func Filter(l Logger, min Level) Logger {
+	return &filter{l: l, min: min}
+}
+
+func (f *filter) Log(level Level, msg string, fields Fields) {
+	if level >= f.min {
+		f.l.Log(level, msg, fields)
+	}
+}
+
+type stdlib struct {
+	l *log.Logger
+}
+
+// NewStdlib creates a logger writing entries to a standard library logger in
+// the form "[LEVEL] msg key=value", fields are sorted by key
+func NewStdlib(l *log.Logger) Logger {
+	return &stdlib{l: l}
+}
+
+func (s *stdlib) Log(level Level, msg string, fields Fields) {
+	var buf bytes.Buffer
+	buf.WriteString("[" + level.String() + "] " + msg)
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := fmt.Sprint(fields[k])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		buf.WriteString(" " + k + "=" + v)
+	}
+
+	s.l.Print(buf.String())
+}
+
+// levels maps the prefixes written by memberlist to levels
+var levels = map[string]Level{
+	"[DEBUG]": DebugLevel,
+	"[INFO]":  InfoLevel,
+	"[WARN]":  WarnLevel,
+	"[ERR]":   ErrorLevel,
+	"[ERROR]": ErrorLevel,
+}
+
+type writer struct {
+	mu        sync.Mutex
+	l         Logger
+	component string
+	buf       []byte
+}
+
+// NewWriter creates a writer that logs every line written to it with a
+// component field. Lines starting with a level prefix such as "[WARN]" are
+// logged at that level and others at info, a "component: " prefix is removed
+func NewWriter(l Logger, component string) io.Writer {
+	return &writer{l: l, component: component}
+}
+
+// StdLogger creates a standard library logger that logs through l, for
+// libraries such as memberlist that only accept a *log.Logger
+func StdLogger(l Logger, component string) *log.Logger {
+	return log.New(NewWriter(l, component), "", 0)
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i == -1 {
+			break
+		}
+
+		w.line(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (w *writer) line(line string) {
+	level := InfoLevel
+	if strings.HasPrefix(line, "[") {
+		if i := strings.IndexByte(line, ']'); i != -1 {
+			if l, ok := levels[line[:i+1]]; ok {
+				level = l
+				line = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+
+	line = strings.TrimPrefix(line, w.component+": ")
+
+	w.l.Log(level, line, Fields{"component": w.component})
+}
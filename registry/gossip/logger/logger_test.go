@@ -0,0 +1,113 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type entry struct {
+	level  Level
+	msg    string
+	fields Fields
+}
+
+type recorder struct {
+	entries []entry
+}
+
+func (r *recorder) Log(level Level, msg string, fields Fields) {
+	r.entries = append(r.entries, entry{level, msg, fields})
+}
+
+func TestStdlib(t *testing.T) {
+	Convey("Given a standard library logger", t, func() {
+		var buf bytes.Buffer
+		l := NewStdlib(log.New(&buf, "", 0))
+
+		Convey("When an entry with fields is logged", func() {
+			l.Log(ErrorLevel, "Error merging", Fields{
+				"member": "a",
+				"error":  fmt.Errorf("bad message"),
+			})
+
+			Convey("Then the level, message and sorted fields should be written", func() {
+				So(buf.String(), ShouldEqual, "[ERROR] Error merging error=\"bad message\" member=a\n")
+			})
+		})
+
+		Convey("When an entry without fields is logged", func() {
+			l.Log(InfoLevel, "Started", nil)
+
+			Convey("Then only the level and message should be written", func() {
+				So(buf.String(), ShouldEqual, "[INFO] Started\n")
+			})
+		})
+	})
+}
+
+func TestFilter(t *testing.T) {
+	Convey("Given a filtered logger", t, func() {
+		r := &recorder{}
+		l := Filter(r, WarnLevel)
+
+		Convey("When entries of every level are logged", func() {
+			l.Log(DebugLevel, "debug", nil)
+			l.Log(InfoLevel, "info", nil)
+			l.Log(WarnLevel, "warn", nil)
+			l.Log(ErrorLevel, "error", nil)
+
+			Convey("Then only entries at or above the minimum should be logged", func() {
+				So(r.entries, ShouldHaveLength, 2)
+				So(r.entries[0].msg, ShouldEqual, "warn")
+				So(r.entries[1].msg, ShouldEqual, "error")
+			})
+		})
+	})
+}
+
+func TestStdLogger(t *testing.T) {
+	Convey("Given a standard library logger writing through a logger", t, func() {
+		r := &recorder{}
+		l := StdLogger(r, "memberlist")
+
+		Convey("When memberlist style lines are written", func() {
+			l.Printf("[WARN] memberlist: Was able to connect to %s", "a")
+			l.Printf("[ERR] memberlist: Failed to send")
+			l.Printf("[DEBUG] memberlist: Stream connection")
+			l.Printf("no level")
+
+			Convey("Then they should be logged at their level without the prefix", func() {
+				So(r.entries, ShouldHaveLength, 4)
+
+				So(r.entries[0].level, ShouldEqual, WarnLevel)
+				So(r.entries[0].msg, ShouldEqual, "Was able to connect to a")
+				So(r.entries[0].fields["component"], ShouldEqual, "memberlist")
+
+				So(r.entries[1].level, ShouldEqual, ErrorLevel)
+				So(r.entries[1].msg, ShouldEqual, "Failed to send")
+
+				So(r.entries[2].level, ShouldEqual, DebugLevel)
+
+				So(r.entries[3].level, ShouldEqual, InfoLevel)
+				So(r.entries[3].msg, ShouldEqual, "no level")
+			})
+		})
+
+		Convey("When a line is written in parts", func() {
+			w := NewWriter(r, "memberlist")
+			w.Write([]byte("[INFO] memberlist: par"))
+			So(r.entries, ShouldBeEmpty)
+
+			w.Write([]byte("tial\n"))
+
+			Convey("Then it should be logged once complete", func() {
+				So(r.entries, ShouldHaveLength, 1)
+				So(r.entries[0].msg, ShouldEqual, "partial")
+			})
+		})
+	})
+}
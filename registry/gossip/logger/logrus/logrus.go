@@ -0,0 +1,31 @@
+// Package logrus logs gossip registry entries with logrus.
+package logrus
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/logger"
+)
+
+type adapter struct {
+	l logrus.FieldLogger
+}
+
+// New creates a logger that logs entries to l with their fields
+func New(l logrus.FieldLogger) logger.Logger {
+	return &adapter{l: l}
+}
+
+func (a *adapter) Log(level logger.Level, msg string, fields logger.Fields) {
+	entry := a.l.WithFields(logrus.Fields(fields))
+
+	switch level {
+	case logger.DebugLevel:
+		entry.Debug(msg)
+	case logger.InfoLevel:
+		entry.Info(msg)
+	case logger.WarnLevel:
+		entry.Warn(msg)
+	default:
+		entry.Error(msg)
+	}
+}
@@ -0,0 +1,35 @@
+package logrus
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/logger"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLogrus(t *testing.T) {
+	Convey("Given a logrus logger", t, func() {
+		var buf bytes.Buffer
+
+		l := logrus.New()
+		l.Out = &buf
+		l.Formatter = &logrus.JSONFormatter{}
+		l.Level = logrus.DebugLevel
+
+		Convey("When an entry is logged through the adapter", func() {
+			New(l).Log(logger.WarnLevel, "Error joining cluster", logger.Fields{"member": "a"})
+
+			var entry map[string]interface{}
+			So(json.Unmarshal(buf.Bytes(), &entry), ShouldBeNil)
+
+			Convey("Then it should be logged with its level and fields", func() {
+				So(entry["level"], ShouldEqual, "warning")
+				So(entry["msg"], ShouldEqual, "Error joining cluster")
+				So(entry["member"], ShouldEqual, "a")
+			})
+		})
+	})
+}
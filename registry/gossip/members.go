@@ -0,0 +1,131 @@
+package gossip
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/logger"
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/state"
+	"github.com/hashicorp/memberlist"
+)
+
+// members tracks members that left the cluster and disables the nodes they
+// own once the grace period has passed
+type members struct {
+	mu      sync.Mutex
+	grace   time.Duration
+	pending map[string]*time.Timer
+	stopped bool
+}
+
+// Leave schedules f to run once the grace period has passed
+func (m *members) Leave(name string, f func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopped {
+		return
+	}
+
+	if m.pending == nil {
+		m.pending = make(map[string]*time.Timer)
+	}
+
+	if t, ok := m.pending[name]; ok {
+		t.Stop()
+	}
+
+	m.pending[name] = time.AfterFunc(m.grace, func() {
+		m.mu.Lock()
+		delete(m.pending, name)
+		stopped := m.stopped
+		m.mu.Unlock()
+
+		if !stopped {
+			f()
+		}
+	})
+}
+
+// Join cancels a pending leave
+func (m *members) Join(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.pending[name]; ok {
+		t.Stop()
+		delete(m.pending, name)
+	}
+}
+
+// Leaving returns the names of members with a pending leave
+func (m *members) Leaving() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.pending))
+	for name := range m.pending {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Stop cancels all pending leaves
+func (m *members) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stopped = true
+	for name, t := range m.pending {
+		t.Stop()
+		delete(m.pending, name)
+	}
+}
+
+func (g *gossip) NotifyJoin(node *memberlist.Node) {
+	g.members.Join(node.Name)
+
+	// Nodes loaded from a snapshot are current while their owner is alive
+	g.ConfirmOwner(node.Name)
+}
+
+func (g *gossip) NotifyLeave(node *memberlist.Node) {
+	if node.Name == g.name {
+		return
+	}
+
+	g.members.Leave(node.Name, func() {
+		if err := g.DisableOwner(node.Name); err != nil {
+			g.log.Log(logger.ErrorLevel, "Error disabling nodes", logger.Fields{"member": node.Name, "error": err})
+		}
+	})
+}
+
+func (g *gossip) NotifyUpdate(node *memberlist.Node) {
+}
+
+// reassert registers local services again if a merged change removed any of
+// their nodes, for example another member disabled them after a network
+// partition healed
+func (g *gossip) reassert(diff []*state.Change) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, c := range diff {
+		if len(c.Removed) == 0 {
+			continue
+		}
+
+		l, ok := g.local.Get(c.Service.Name, c.Service.Version)
+		if !ok {
+			continue
+		}
+
+		for _, node := range c.Removed {
+			if i, _ := state.NodeByID(l.Service.Nodes, node.Id); i != -1 {
+				g.register(l)
+				break
+			}
+		}
+	}
+}
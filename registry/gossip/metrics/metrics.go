@@ -0,0 +1,105 @@
+// Package metrics defines the metrics recorded by the gossip registry and
+// its state. Metrics are recorded through the Metrics interface, see the
+// prometheus package for an adapter.
+package metrics
+
+// Metrics records metrics by name, names not known to the implementation
+// should be ignored
+type Metrics interface {
+	// Add adds delta to a counter
+	Add(name string, delta float64)
+
+	// Set sets a gauge
+	Set(name string, value float64)
+
+	// Observe records a value in a histogram
+	Observe(name string, value float64)
+}
+
+// Metric names
+const (
+	// Registers counts local registrations that added or changed a service,
+	// registering again only to refresh the expiry is not counted
+	Registers = "registers_total"
+
+	// Deregisters counts services deregistered locally
+	Deregisters = "deregisters_total"
+
+	// MergeDuration is the time taken to merge a remote state or broadcast
+	MergeDuration = "merge_duration_seconds"
+
+	// MergeDiffSize is the number of changes produced by a merge
+	MergeDiffSize = "merge_diff_size"
+
+	// MergeErrors counts remote states and broadcasts that failed to decode
+	// or merge
+	MergeErrors = "merge_errors_total"
+
+	// LocalStateBytes is the size of the last full local state sent on
+	// push/pull
+	LocalStateBytes = "local_state_bytes"
+
+	// LocalDigestBytes is the size of the last digest sent on push/pull
+	LocalDigestBytes = "local_digest_bytes"
+
+	// BroadcastQueue is the number of broadcasts waiting to be sent
+	BroadcastQueue = "broadcast_queue_length"
+
+	// Services is the number of service versions with enabled nodes
+	Services = "services"
+
+	// Nodes is the number of enabled nodes
+	Nodes = "nodes"
+
+	// Tombstones is the number of disabled nodes, updated on clean
+	Tombstones = "tombstones"
+
+	// Cleans counts clean cycles
+	Cleans = "cleans_total"
+
+	// WatcherDrops counts results dropped because a watchers queue was full
+	WatcherDrops = "watcher_drops_total"
+)
+
+// Kind is the kind of a metric
+type Kind int
+
+// Metric kinds
+const (
+	Counter Kind = iota
+	Gauge
+	Histogram
+)
+
+// Desc describes a metric
+type Desc struct {
+	Name string
+	Help string
+	Kind Kind
+}
+
+// Descs describes every metric recorded by the registry
+var Descs = []Desc{
+	{Registers, "Local registrations that added or changed a service.", Counter},
+	{Deregisters, "Services deregistered locally.", Counter},
+	{MergeDuration, "Time taken to merge a remote state or broadcast.", Histogram},
+	{MergeDiffSize, "Changes produced by a merge.", Histogram},
+	{MergeErrors, "Remote states and broadcasts that failed to decode or merge.", Counter},
+	{LocalStateBytes, "Size of the last full local state sent on push/pull.", Gauge},
+	{LocalDigestBytes, "Size of the last digest sent on push/pull.", Gauge},
+	{BroadcastQueue, "Broadcasts waiting to be sent.", Gauge},
+	{Services, "Service versions with enabled nodes.", Gauge},
+	{Nodes, "Enabled nodes.", Gauge},
+	{Tombstones, "Disabled nodes kept until they are compacted.", Gauge},
+	{Cleans, "Clean cycles.", Counter},
+	{WatcherDrops, "Results dropped because a watchers queue was full.", Counter},
+}
+
+// Nop discards all metrics
+var Nop Metrics = nop{}
+
+type nop struct{}
+
+func (nop) Add(string, float64)     {}
+func (nop) Set(string, float64)     {}
+func (nop) Observe(string, float64) {}
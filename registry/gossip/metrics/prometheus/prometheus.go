@@ -0,0 +1,95 @@
+// Package prometheus records gossip registry metrics with Prometheus.
+package prometheus
+
+import (
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/metrics"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultNamespace is the namespace used when none is given
+const DefaultNamespace = "gossip_registry"
+
+type recorder struct {
+	counters   map[string]prometheus.Counter
+	gauges     map[string]prometheus.Gauge
+	histograms map[string]prometheus.Histogram
+}
+
+// New creates metrics that are registered with the registerer, every metric
+// name is prefixed with the namespace
+func New(namespace string, r prometheus.Registerer) (metrics.Metrics, error) {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	rec := &recorder{
+		counters:   make(map[string]prometheus.Counter),
+		gauges:     make(map[string]prometheus.Gauge),
+		histograms: make(map[string]prometheus.Histogram),
+	}
+
+	for _, d := range metrics.Descs {
+		var c prometheus.Collector
+
+		switch d.Kind {
+		case metrics.Counter:
+			counter := prometheus.NewCounter(prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      d.Name,
+				Help:      d.Help,
+			})
+			rec.counters[d.Name] = counter
+			c = counter
+		case metrics.Gauge:
+			gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      d.Name,
+				Help:      d.Help,
+			})
+			rec.gauges[d.Name] = gauge
+			c = gauge
+		case metrics.Histogram:
+			histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      d.Name,
+				Help:      d.Help,
+				Buckets:   buckets(d.Name),
+			})
+			rec.histograms[d.Name] = histogram
+			c = histogram
+		}
+
+		if err := r.Register(c); err != nil {
+			return nil, errors.Wrapf(err, "Error registering metric %s", d.Name)
+		}
+	}
+
+	return rec, nil
+}
+
+// buckets returns the histogram buckets for a metric
+func buckets(name string) []float64 {
+	if name == metrics.MergeDiffSize {
+		return prometheus.ExponentialBuckets(1, 4, 8)
+	}
+	return prometheus.DefBuckets
+}
+
+func (r *recorder) Add(name string, delta float64) {
+	if c, ok := r.counters[name]; ok {
+		c.Add(delta)
+	}
+}
+
+func (r *recorder) Set(name string, value float64) {
+	if g, ok := r.gauges[name]; ok {
+		g.Set(value)
+	}
+}
+
+func (r *recorder) Observe(name string, value float64) {
+	if h, ok := r.histograms[name]; ok {
+		h.Observe(value)
+	}
+}
@@ -0,0 +1,61 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrometheus(t *testing.T) {
+	Convey("Given prometheus metrics", t, func() {
+		reg := prometheus.NewRegistry()
+
+		m, err := New("", reg)
+		So(err, ShouldBeNil)
+
+		Convey("When metrics are recorded", func() {
+			m.Add(metrics.Registers, 1)
+			m.Add(metrics.Registers, 2)
+			m.Set(metrics.Nodes, 5)
+			m.Observe(metrics.MergeDuration, 0.5)
+			m.Add("unknown", 1)
+
+			families, err := reg.Gather()
+			So(err, ShouldBeNil)
+
+			values := make(map[string]float64)
+			for _, f := range families {
+				for _, metric := range f.GetMetric() {
+					switch {
+					case metric.Counter != nil:
+						values[f.GetName()] = metric.GetCounter().GetValue()
+					case metric.Gauge != nil:
+						values[f.GetName()] = metric.GetGauge().GetValue()
+					case metric.Histogram != nil:
+						values[f.GetName()] = float64(metric.GetHistogram().GetSampleCount())
+					}
+				}
+			}
+
+			Convey("Then every metric should be registered", func() {
+				So(families, ShouldHaveLength, len(metrics.Descs))
+			})
+
+			Convey("Then the values should be recorded under the namespace", func() {
+				So(values[DefaultNamespace+"_"+metrics.Registers], ShouldEqual, 3)
+				So(values[DefaultNamespace+"_"+metrics.Nodes], ShouldEqual, 5)
+				So(values[DefaultNamespace+"_"+metrics.MergeDuration], ShouldEqual, 1)
+			})
+		})
+
+		Convey("When metrics are registered twice", func() {
+			_, err := New("", reg)
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -1,15 +1,21 @@
 package gossip
 
 import (
+	"bytes"
 	"log"
 	"net"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/ThatsMrTalbot/cluster/clock"
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/logger"
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/metrics"
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/state"
 	"github.com/facebookgo/freeport"
 	"github.com/hashicorp/memberlist"
 	"github.com/micro/go-micro/registry"
+	"github.com/pkg/errors"
 
 	"golang.org/x/net/context"
 )
@@ -25,11 +31,33 @@ const (
 )
 
 var (
-	// DefaultKey is the default key, you should change this if using secure
+	// DefaultKey is the key used in secure mode when none is set, it is
+	// refused unless AllowDefaultKey is set
 	DefaultKey = []byte("DefaultGossipKey")
 
-	// ExpiryTick is the interval to perform cleans on the state
+	// ExpiryTick is the default interval to clean expired nodes from the
+	// state, see CleanInterval
 	ExpiryTick = time.Second * 10
+
+	// DefaultLeaveTimeout is the time to wait for the leave message to propagate
+	DefaultLeaveTimeout = time.Second * 5
+
+	// DefaultMemberGracePeriod is the time to wait before disabling the nodes
+	// of a member that left or died
+	DefaultMemberGracePeriod = time.Second * 10
+
+	// DefaultJoinRetry is the initial wait between failed joins
+	DefaultJoinRetry = time.Second
+
+	// DefaultJoinRetryMax is the maximum wait between failed joins
+	DefaultJoinRetryMax = time.Minute
+
+	// DefaultSnapshotInterval is the default interval to write snapshots
+	DefaultSnapshotInterval = time.Second * 30
+
+	// DefaultSnapshotStale is the default time nodes loaded from a snapshot
+	// are kept, see SnapshotStale
+	DefaultSnapshotStale = time.Minute
 )
 
 type contextModeKey struct{}
@@ -55,6 +83,136 @@ func getMemberlistConfig(options *registry.Options) *memberlist.Config {
 	return memberlist.DefaultWANConfig()
 }
 
+type contextMemberlistConfigKey struct{}
+
+// MemberlistConfig sets a function that can change the memberlist config
+// before the memberlist is created. It runs after every other option has been
+// applied, the result is validated
+func MemberlistConfig(f func(*memberlist.Config)) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextMemberlistConfigKey{}, f)
+	}
+}
+
+func applyMemberlistConfig(options *registry.Options, config *memberlist.Config) {
+	if f, ok := options.Context.Value(contextMemberlistConfigKey{}).(func(*memberlist.Config)); ok {
+		f(config)
+	}
+}
+
+type contextTuningKey struct{}
+
+// tuning holds the memberlist settings changed by the tuning options
+type tuning []func(*memberlist.Config)
+
+func withTuning(o *registry.Options, f func(*memberlist.Config)) {
+	t, _ := o.Context.Value(contextTuningKey{}).(tuning)
+	t = append(t[:len(t):len(t)], f)
+	o.Context = context.WithValue(o.Context, contextTuningKey{}, t)
+}
+
+func applyTuning(options *registry.Options, config *memberlist.Config) {
+	t, _ := options.Context.Value(contextTuningKey{}).(tuning)
+	for _, f := range t {
+		f(config)
+	}
+}
+
+// ProbeInterval sets the interval between failure detection probes
+func ProbeInterval(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		withTuning(o, func(c *memberlist.Config) {
+			c.ProbeInterval = d
+		})
+	}
+}
+
+// ProbeTimeout sets the time to wait for a probe to be acknowledged, it must
+// be less than the probe interval
+func ProbeTimeout(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		withTuning(o, func(c *memberlist.Config) {
+			c.ProbeTimeout = d
+		})
+	}
+}
+
+// SuspicionMult sets the suspicion multiplier, a suspected member is declared
+// dead after SuspicionMult * log(N+1) * ProbeInterval
+func SuspicionMult(n int) registry.Option {
+	return func(o *registry.Options) {
+		withTuning(o, func(c *memberlist.Config) {
+			c.SuspicionMult = n
+		})
+	}
+}
+
+// GossipNodes sets the number of members gossiped to every gossip interval
+func GossipNodes(n int) registry.Option {
+	return func(o *registry.Options) {
+		withTuning(o, func(c *memberlist.Config) {
+			c.GossipNodes = n
+		})
+	}
+}
+
+// GossipInterval sets the interval between gossip rounds, zero disables
+// gossip so broadcasts are only piggybacked on probes
+func GossipInterval(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		withTuning(o, func(c *memberlist.Config) {
+			c.GossipInterval = d
+		})
+	}
+}
+
+// PushPullInterval sets the interval between full state syncs with a random
+// member, zero disables them
+func PushPullInterval(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		withTuning(o, func(c *memberlist.Config) {
+			c.PushPullInterval = d
+		})
+	}
+}
+
+// RetransmitMult sets the retransmit multiplier of registry broadcasts and
+// memberlist messages, they are retransmitted RetransmitMult * log(N+1) times.
+// The memberlist default of the network mode is used if it is not set
+func RetransmitMult(n int) registry.Option {
+	return func(o *registry.Options) {
+		withTuning(o, func(c *memberlist.Config) {
+			c.RetransmitMult = n
+		})
+	}
+}
+
+// validateMemberlistConfig checks for settings memberlist would misbehave
+// with rather than reject
+func validateMemberlistConfig(config *memberlist.Config) error {
+	switch {
+	case config.ProbeInterval <= 0:
+		return errors.New("Probe interval must be positive")
+	case config.ProbeTimeout <= 0:
+		return errors.New("Probe timeout must be positive")
+	case config.ProbeTimeout >= config.ProbeInterval:
+		return errors.Errorf("Probe timeout %s must be less than the probe interval %s", config.ProbeTimeout, config.ProbeInterval)
+	case config.SuspicionMult < 1:
+		return errors.New("Suspicion multiplier must be at least 1")
+	case config.GossipInterval < 0:
+		return errors.New("Gossip interval must not be negative")
+	case config.GossipInterval > 0 && config.GossipNodes < 1:
+		return errors.New("Gossip nodes must be at least 1 when gossip is enabled")
+	case config.PushPullInterval < 0:
+		return errors.New("Push/pull interval must not be negative")
+	case config.RetransmitMult < 1:
+		return errors.New("Retransmit multiplier must be at least 1")
+	case config.TCPTimeout <= 0:
+		return errors.New("TCP timeout must be positive")
+	}
+	return nil
+}
+
 type contextSecretKey struct{}
 
 // SecretKey sets the secret key for gossip
@@ -64,14 +222,62 @@ func SecretKey(k []byte) registry.Option {
 	}
 }
 
+type contextSecretKeysKey struct{}
+
+type secretKeys struct {
+	Primary []byte
+	Keys    [][]byte
+}
+
+// SecretKeys installs several keys for gossip, messages are encrypted with
+// the primary key and decrypted with any of the keys. Keys can be changed at
+// runtime with KeyManager
+func SecretKeys(primary []byte, keys ...[]byte) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextSecretKeysKey{}, secretKeys{
+			Primary: primary,
+			Keys:    keys,
+		})
+	}
+}
+
+type contextAllowDefaultKeyKey struct{}
+
+// AllowDefaultKey allows secure mode to use DefaultKey, which anyone can read
+// from the source. It should only be used for testing
+func AllowDefaultKey(allow bool) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextAllowDefaultKeyKey{}, allow)
+	}
+}
+
 func applySecretKey(options *registry.Options, config *memberlist.Config) error {
-	if options.Secure {
-		key := DefaultKey
-		if k, ok := options.Context.Value(contextSecretKey{}).([]byte); ok {
-			key = k
-		}
-		config.SecretKey = key
+	if !options.Secure {
+		return nil
+	}
+
+	primary := DefaultKey
+	var keys [][]byte
+
+	if k, ok := options.Context.Value(contextSecretKey{}).([]byte); ok {
+		primary = k
+	}
+	if k, ok := options.Context.Value(contextSecretKeysKey{}).(secretKeys); ok {
+		primary = k.Primary
+		keys = k.Keys
+	}
+
+	allow, _ := options.Context.Value(contextAllowDefaultKeyKey{}).(bool)
+	if !allow && bytes.Equal(primary, DefaultKey) {
+		return errors.New("Secure mode needs a secret key, set one with SecretKey or SecretKeys")
 	}
+
+	keyring, err := memberlist.NewKeyring(keys, primary)
+	if err != nil {
+		return err
+	}
+
+	config.Keyring = keyring
 	return nil
 }
 
@@ -142,17 +348,305 @@ func applyAdvertise(options *registry.Options, config *memberlist.Config) error
 
 type contextLoggerKey struct{}
 
-// Logger sets the logger used for the memberlist instance
+// Logger sets a standard library logger for the registry and the memberlist
+// instance, see StructuredLogger
 func Logger(l *log.Logger) registry.Option {
+	return StructuredLogger(logger.NewStdlib(l))
+}
+
+// StructuredLogger sets the logger for the registry, memberlist output is
+// logged through it with the component field set to memberlist
+func StructuredLogger(l logger.Logger) registry.Option {
 	return func(o *registry.Options) {
 		o.Context = context.WithValue(o.Context, contextLoggerKey{}, l)
 	}
 }
 
-func applyLogger(options *registry.Options, config *memberlist.Config) *log.Logger {
-	if logger, ok := options.Context.Value(contextLoggerKey{}).(*log.Logger); ok {
-		config.Logger = logger
-		return logger
+func applyLogger(options *registry.Options, config *memberlist.Config) logger.Logger {
+	l, ok := options.Context.Value(contextLoggerKey{}).(logger.Logger)
+	if !ok {
+		l = logger.NewStdlib(log.New(os.Stderr, "", log.LstdFlags))
+	}
+
+	config.Logger = logger.StdLogger(l, "memberlist")
+	return l
+}
+
+type contextLeaveTimeoutKey struct{}
+
+// LeaveTimeout sets the time to wait for the leave message to propagate
+func LeaveTimeout(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextLeaveTimeoutKey{}, d)
+	}
+}
+
+func getLeaveTimeout(options *registry.Options) time.Duration {
+	if d, ok := options.Context.Value(contextLeaveTimeoutKey{}).(time.Duration); ok {
+		return d
+	}
+	return DefaultLeaveTimeout
+}
+
+type contextMemberGracePeriodKey struct{}
+
+// MemberGracePeriod sets the time to wait before disabling the nodes of a
+// member that left or died, the member can rejoin within this time
+func MemberGracePeriod(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextMemberGracePeriodKey{}, d)
+	}
+}
+
+func getMemberGracePeriod(options *registry.Options) time.Duration {
+	if d, ok := options.Context.Value(contextMemberGracePeriodKey{}).(time.Duration); ok {
+		return d
+	}
+	return DefaultMemberGracePeriod
+}
+
+type contextJoinRetryKey struct{}
+
+type joinRetry struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// JoinRetry sets the backoff between failed joins, the wait starts at min
+// and doubles after every failure up to max. Min must be positive and max must
+// not be less than min
+func JoinRetry(min time.Duration, max time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextJoinRetryKey{}, joinRetry{Min: min, Max: max})
+	}
+}
+
+func getJoinRetry(options *registry.Options) joinRetry {
+	if r, ok := options.Context.Value(contextJoinRetryKey{}).(joinRetry); ok {
+		return r
+	}
+	return joinRetry{Min: DefaultJoinRetry, Max: DefaultJoinRetryMax}
+}
+
+func validateJoinRetry(retry joinRetry) error {
+	switch {
+	case retry.Min <= 0:
+		return errors.New("Minimum join retry must be positive")
+	case retry.Max < retry.Min:
+		return errors.Errorf("Maximum join retry %s must not be less than the minimum %s", retry.Max, retry.Min)
+	}
+	return nil
+}
+
+type contextWatchQueueKey struct{}
+
+type watchQueue struct {
+	Size   int
+	Policy state.OverflowPolicy
+}
+
+// WatchQueue sets the number of results queued per watcher and the policy
+// used when a watcher falls behind
+func WatchQueue(size int, policy state.OverflowPolicy) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextWatchQueueKey{}, watchQueue{Size: size, Policy: policy})
+	}
+}
+
+type contextTombstoneRetentionKey struct{}
+
+// TombstoneRetention sets how long removed nodes are kept before they are
+// compacted, see state.TombstoneRetention
+func TombstoneRetention(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextTombstoneRetentionKey{}, d)
+	}
+}
+
+type contextWatchHistoryKey struct{}
+
+// WatchHistory sets the number of published results kept so watchers can
+// resume with state.WatchSince, see state.HistorySize
+func WatchHistory(n int) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextWatchHistoryKey{}, n)
+	}
+}
+
+type contextCodecKey struct{}
+
+// Codec sets the codec used to encode services for members of older releases,
+// see state.PayloadCodec
+func Codec(c state.Codec) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextCodecKey{}, c)
+	}
+}
+
+type contextLegacyPayloadKey struct{}
+
+// LegacyPayload sets whether services are also sent in the encoding read by
+// members of older releases, it is enabled by default, see
+// state.LegacyPayload
+func LegacyPayload(enabled bool) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextLegacyPayloadKey{}, enabled)
+	}
+}
+
+type contextCleanIntervalKey struct{}
+
+// CleanInterval sets the interval to clean expired nodes from the state, zero
+// disables cleaning so it must be triggered with Clean
+func CleanInterval(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextCleanIntervalKey{}, d)
+	}
+}
+
+func getCleanInterval(options *registry.Options) time.Duration {
+	if d, ok := options.Context.Value(contextCleanIntervalKey{}).(time.Duration); ok {
+		return d
+	}
+	return ExpiryTick
+}
+
+type contextClockKey struct{}
+
+// Clock sets the clock the state reads expiry and change timestamps from
+func Clock(c clock.Clock) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextClockKey{}, c)
+	}
+}
+
+type contextMetricsKey struct{}
+
+// Metrics sets where registry and state metrics are recorded, see the
+// metrics/prometheus package for a Prometheus adapter
+func Metrics(m metrics.Metrics) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextMetricsKey{}, m)
+	}
+}
+
+func getMetrics(options *registry.Options) metrics.Metrics {
+	if m, ok := options.Context.Value(contextMetricsKey{}).(metrics.Metrics); ok {
+		return m
+	}
+	return metrics.Nop
+}
+
+type contextSnapshotPathKey struct{}
+
+// SnapshotPath enables writing the state to a file, the file is loaded at
+// startup so the registry does not start empty if the whole cluster restarts
+func SnapshotPath(path string) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextSnapshotPathKey{}, path)
+	}
+}
+
+func getSnapshotPath(options *registry.Options) string {
+	if path, ok := options.Context.Value(contextSnapshotPathKey{}).(string); ok {
+		return path
+	}
+	return ""
+}
+
+type contextSnapshotIntervalKey struct{}
+
+// SnapshotInterval sets the interval to write snapshots, see SnapshotPath
+func SnapshotInterval(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextSnapshotIntervalKey{}, d)
+	}
+}
+
+func getSnapshotInterval(options *registry.Options) time.Duration {
+	if d, ok := options.Context.Value(contextSnapshotIntervalKey{}).(time.Duration); ok {
+		return d
+	}
+	return DefaultSnapshotInterval
+}
+
+type contextSnapshotStaleKey struct{}
+
+// SnapshotStale sets how long nodes loaded from a snapshot are kept unless
+// they are changed since, for example registered again, or their owner is an
+// alive member, see SnapshotPath
+func SnapshotStale(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextSnapshotStaleKey{}, d)
+	}
+}
+
+func getSnapshotStale(options *registry.Options) time.Duration {
+	if d, ok := options.Context.Value(contextSnapshotStaleKey{}).(time.Duration); ok {
+		return d
+	}
+	return DefaultSnapshotStale
+}
+
+func getStateOptions(options *registry.Options) []state.Option {
+	var opts []state.Option
+	if q, ok := options.Context.Value(contextWatchQueueKey{}).(watchQueue); ok {
+		opts = append(opts, state.WatchQueueSize(q.Size), state.WatchOverflow(q.Policy))
+	}
+	if d, ok := options.Context.Value(contextTombstoneRetentionKey{}).(time.Duration); ok {
+		opts = append(opts, state.TombstoneRetention(d))
+	}
+	if n, ok := options.Context.Value(contextWatchHistoryKey{}).(int); ok {
+		opts = append(opts, state.HistorySize(n))
+	}
+	if c, ok := options.Context.Value(contextCodecKey{}).(state.Codec); ok {
+		opts = append(opts, state.PayloadCodec(c))
+	}
+	if enabled, ok := options.Context.Value(contextLegacyPayloadKey{}).(bool); ok {
+		opts = append(opts, state.LegacyPayload(enabled))
+	}
+	if m, ok := options.Context.Value(contextMetricsKey{}).(metrics.Metrics); ok {
+		opts = append(opts, state.Metrics(m))
+	}
+	if c, ok := options.Context.Value(contextClockKey{}).(clock.Clock); ok {
+		opts = append(opts, state.Clock(c))
+	}
+	return opts
+}
+
+type contextRegisterIntervalKey struct{}
+
+// RegisterInterval enables re-registering services registered with a TTL on
+// the given interval, so they do not expire while the registry is running. The
+// interval must be less than the TTL, registering with a shorter TTL fails
+func RegisterInterval(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextRegisterIntervalKey{}, d)
+	}
+}
+
+func getRegisterInterval(options *registry.Options) time.Duration {
+	if d, ok := options.Context.Value(contextRegisterIntervalKey{}).(time.Duration); ok {
+		return d
+	}
+	return 0
+}
+
+type contextDigestSyncKey struct{}
+
+// DigestSync sets whether periodic state syncs exchange digests instead of the
+// full state, only services whose digest differs are then sent to the other
+// member. It is disabled by default as members of older releases cannot
+// parse digests, enable it once every member understands them
+func DigestSync(enabled bool) registry.Option {
+	return func(o *registry.Options) {
+		o.Context = context.WithValue(o.Context, contextDigestSyncKey{}, enabled)
+	}
+}
+
+func getDigestSync(options *registry.Options) bool {
+	if enabled, ok := options.Context.Value(contextDigestSyncKey{}).(bool); ok {
+		return enabled
 	}
-	return log.New(os.Stderr, "", log.LstdFlags)
+	return false
 }
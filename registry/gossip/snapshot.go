@@ -0,0 +1,119 @@
+package gossip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/logger"
+	"github.com/pkg/errors"
+)
+
+// snapshotMagic starts every snapshot file
+var snapshotMagic = []byte("GSNP")
+
+// snapshot writes the state to disk on the interval until the registry is
+// closed
+func (g *gossip) snapshot(path string, d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.writeSnapshot(path)
+		case <-g.done:
+			return
+		}
+	}
+}
+
+// writeSnapshot writes the state to disk, errors are logged
+func (g *gossip) writeSnapshot(path string) {
+	byt, err := g.State.LocalState()
+	if err != nil {
+		g.log.Log(logger.ErrorLevel, "Error getting state for snapshot", logger.Fields{"error": err})
+		return
+	}
+
+	if err := writeSnapshot(path, byt); err != nil {
+		g.log.Log(logger.ErrorLevel, "Error writing snapshot", logger.Fields{"path": path, "error": err})
+	}
+}
+
+// loadSnapshot loads the state from disk, a missing snapshot is not an error.
+// Loaded nodes expire after the stale period unless they are refreshed
+func (g *gossip) loadSnapshot(path string, stale time.Duration) {
+	byt, err := readSnapshot(path)
+	if os.IsNotExist(errors.Cause(err)) {
+		return
+	}
+
+	if err != nil {
+		g.log.Log(logger.WarnLevel, "Error reading snapshot, starting empty", logger.Fields{"path": path, "error": err})
+		return
+	}
+
+	if err := g.State.Load(byt, stale); err != nil {
+		g.log.Log(logger.WarnLevel, "Error loading snapshot, starting empty", logger.Fields{"path": path, "error": err})
+	}
+}
+
+// writeSnapshot writes the data with a checksum to a temporary file and
+// renames it over the snapshot, so a crash never leaves a partial snapshot
+func writeSnapshot(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "Error creating temporary snapshot")
+	}
+
+	defer os.Remove(tmp.Name())
+
+	header := make([]byte, len(snapshotMagic)+4)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint32(header[len(snapshotMagic):], crc32.ChecksumIEEE(data))
+
+	if _, err := tmp.Write(append(header, data...)); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Error writing snapshot")
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Error syncing snapshot")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "Error closing snapshot")
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "Error renaming snapshot")
+	}
+
+	return nil
+}
+
+// readSnapshot reads a snapshot and verifies its checksum
+func readSnapshot(path string) ([]byte, error) {
+	byt, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading snapshot")
+	}
+
+	size := len(snapshotMagic) + 4
+	if len(byt) < size || !bytes.Equal(byt[:len(snapshotMagic)], snapshotMagic) {
+		return nil, errors.New("Snapshot is not valid")
+	}
+
+	data := byt[size:]
+	if binary.BigEndian.Uint32(byt[len(snapshotMagic):size]) != crc32.ChecksumIEEE(data) {
+		return nil, errors.New("Snapshot checksum does not match")
+	}
+
+	return data, nil
+}
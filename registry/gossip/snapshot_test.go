@@ -0,0 +1,98 @@
+package gossip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ThatsMrTalbot/cluster/clock"
+	"github.com/hashicorp/memberlist"
+	"github.com/micro/go-micro/registry"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSnapshot(t *testing.T) {
+	Convey("Given a snapshot path", t, func() {
+		dir, err := ioutil.TempDir("", "snapshot")
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+
+		path := filepath.Join(dir, "state")
+		c := clock.NewFake(time.Unix(1000, 0))
+
+		Convey("When a registry with a service is closed", func() {
+			var owner string
+			WithRegistry(nil, func(r1 registry.Registry, addr string, port int) {
+				owner = r1.(*gossip).name
+				WithService(r1, "test", addr, port, nil)()
+				So(r1.(Registry).Close(), ShouldBeNil)
+			}, SnapshotPath(path))()
+
+			Convey("Then a new registry should start with the service", WithRegistry(nil, func(r2 registry.Registry, _ string, _ int) {
+				service, err := r2.GetService("test")
+				So(err, ShouldBeNil)
+				So(service, ShouldHaveLength, 1)
+				So(service[0].Nodes, ShouldHaveLength, 1)
+			}, SnapshotPath(path)))
+
+			Convey("Then the service should be dropped once stale", WithRegistry(nil, func(r2 registry.Registry, _ string, _ int) {
+				c.Advance(time.Minute * 2)
+				So(r2.(*gossip).Clean(), ShouldBeNil)
+
+				_, err := r2.GetService("test")
+				So(err, ShouldNotBeNil)
+			}, SnapshotPath(path), SnapshotStale(time.Minute), CleanInterval(0), Clock(c)))
+
+			Convey("Then the service should be kept while its owner is alive", WithRegistry(nil, func(r2 registry.Registry, _ string, _ int) {
+				r2.(*gossip).NotifyJoin(&memberlist.Node{Name: owner})
+
+				c.Advance(time.Minute * 2)
+				So(r2.(*gossip).Clean(), ShouldBeNil)
+
+				_, err := r2.GetService("test")
+				So(err, ShouldBeNil)
+			}, SnapshotPath(path), SnapshotStale(time.Minute), CleanInterval(0), Clock(c)))
+		})
+
+		Convey("When the snapshot is corrupt", func() {
+			So(writeSnapshot(path, []byte("state")), ShouldBeNil)
+
+			byt, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			byt[len(byt)-1] = 'x'
+			So(ioutil.WriteFile(path, byt, 0600), ShouldBeNil)
+
+			Convey("Then reading it should fail", func() {
+				_, err := readSnapshot(path)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Then a new registry should start empty", WithRegistry(nil, func(r registry.Registry, _ string, _ int) {
+				services, err := r.ListServices()
+				So(err, ShouldBeNil)
+				So(services, ShouldBeEmpty)
+			}, SnapshotPath(path)))
+		})
+
+		Convey("When a snapshot is written", func() {
+			So(writeSnapshot(path, []byte("state")), ShouldBeNil)
+
+			Convey("Then it should be read back", func() {
+				byt, err := readSnapshot(path)
+				So(err, ShouldBeNil)
+				So(string(byt), ShouldEqual, "state")
+			})
+
+			Convey("Then no temporary files should be left", func() {
+				files, err := ioutil.ReadDir(dir)
+				So(err, ShouldBeNil)
+				So(files, ShouldHaveLength, 1)
+			})
+		})
+	})
+}
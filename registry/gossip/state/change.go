@@ -0,0 +1,26 @@
+package state
+
+import "github.com/micro/go-micro/registry"
+
+// Change is a published result along with what changed. The result is what
+// Next returns, for delete results its service holds the removed nodes
+type Change struct {
+	*registry.Result
+
+	// Previous is the service before the change, nil if it had no nodes
+	Previous *registry.Service
+
+	Added   []*registry.Node
+	Removed []*registry.Node
+	Updated []*registry.Node
+}
+
+// ChangeWatcher is a watcher that returns the change behind each result,
+// watchers returned by State.Watch implement it
+type ChangeWatcher interface {
+	registry.Watcher
+
+	// NextChange blocks until a change is available, it reads from the same
+	// queue as Next
+	NextChange() (*Change, error)
+}
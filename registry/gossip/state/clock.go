@@ -0,0 +1,82 @@
+package state
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ThatsMrTalbot/cluster/clock"
+)
+
+// DefaultMaxSkew is how far ahead of the wall clock an observed timestamp can
+// move a hybrid clock
+var DefaultMaxSkew = time.Minute
+
+// HybridClock is a hybrid logical clock. Timestamps are wall clock
+// nanoseconds that never go backwards and always move past timestamps
+// observed from peers, so a member with a slow clock can still override
+// changes made by a member with a fast clock
+type HybridClock struct {
+	// Wall is the clock timestamps are read from, the system clock is used
+	// if it is nil
+	Wall clock.Clock
+
+	// MaxSkew is how far ahead of the wall clock an observed timestamp can
+	// move the clock, DefaultMaxSkew is used if it is zero
+	MaxSkew time.Duration
+
+	mu   sync.Mutex
+	last int64
+}
+
+// Now returns a timestamp greater than any timestamp previously returned or
+// observed
+func (c *HybridClock) Now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.wall().Now().UnixNano()
+	if now <= c.last {
+		now = c.last + 1
+	}
+	c.last = now
+
+	return now
+}
+
+// Observe moves the clock past a timestamp seen from a peer. Timestamps
+// further ahead of the wall clock than the maximum skew are clamped, so a peer
+// with a broken clock cannot drag the clock far into the future
+func (c *HybridClock) Observe(ts int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	skew := c.MaxSkew
+	if skew == 0 {
+		skew = DefaultMaxSkew
+	}
+
+	if limit := c.wall().Now().Add(skew).UnixNano(); ts > limit {
+		ts = limit
+	}
+
+	if ts > c.last {
+		c.last = ts
+	}
+}
+
+func (c *HybridClock) wall() clock.Clock {
+	if c.Wall == nil {
+		return clock.System
+	}
+	return c.Wall
+}
+
+// newer checks if the change at mod2 from origin2 wins over the change at mod1
+// from origin1. Equal timestamps are ordered by origin so every member picks
+// the same change
+func newer(mod1 int64, origin1 string, mod2 int64, origin2 string) bool {
+	if mod1 != mod2 {
+		return mod2 > mod1
+	}
+	return origin2 > origin1
+}
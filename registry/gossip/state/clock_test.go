@@ -0,0 +1,43 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThatsMrTalbot/cluster/clock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHybridClock(t *testing.T) {
+	Convey("Given a hybrid clock", t, func() {
+		now := time.Now()
+		wall := clock.NewFake(now)
+		clock := &HybridClock{Wall: wall}
+
+		Convey("When timestamps are generated", func() {
+			t1 := clock.Now()
+			t2 := clock.Now()
+
+			Convey("Then they should always increase", func() {
+				So(t2, ShouldBeGreaterThan, t1)
+			})
+		})
+
+		Convey("When a timestamp from a faster clock is observed", func() {
+			future := now.Add(time.Second * 30).UnixNano()
+			clock.Observe(future)
+
+			Convey("Then new timestamps should be after it", func() {
+				So(clock.Now(), ShouldBeGreaterThan, future)
+			})
+		})
+
+		Convey("When a timestamp further ahead than the maximum skew is observed", func() {
+			clock.Observe(now.Add(time.Hour).UnixNano())
+
+			Convey("Then new timestamps should be limited to the maximum skew", func() {
+				So(clock.Now(), ShouldEqual, now.Add(DefaultMaxSkew).UnixNano()+1)
+			})
+		})
+	})
+}
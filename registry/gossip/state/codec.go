@@ -0,0 +1,230 @@
+package state
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/micro/go-micro/registry"
+	"github.com/micro/protobuf/proto"
+	"github.com/pkg/errors"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Codec encodes the registry service stored in Service.Raw, which is only
+// written for members of older releases, see LegacyPayload. The codec ID is
+// stored alongside the encoded service, so members using different codecs can
+// still decode each others services as long as both have the codec registered
+type Codec interface {
+	ID() string
+	Marshal(*registry.Service) ([]byte, error)
+	Unmarshal([]byte, *registry.Service) error
+}
+
+// Built in codecs
+var (
+	// MsgpackCodec encodes services with msgpack, services without a codec ID
+	// are decoded with it
+	MsgpackCodec Codec = msgpackCodec{}
+
+	// ProtobufCodec encodes services as a ServiceRecord
+	ProtobufCodec Codec = protobufCodec{}
+
+	// JSONCodec encodes services as JSON
+	JSONCodec Codec = jsonCodec{}
+
+	// DefaultCodec is the codec used when none is set
+	DefaultCodec = MsgpackCodec
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		"":                 MsgpackCodec,
+		MsgpackCodec.ID():  MsgpackCodec,
+		ProtobufCodec.ID(): ProtobufCodec,
+		JSONCodec.ID():     JSONCodec,
+	}
+)
+
+// RegisterCodec makes a codec available for decoding services, codecs set
+// with PayloadCodec are registered automatically
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[c.ID()] = c
+}
+
+func getCodecByID(id string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[id]
+	if !ok {
+		return nil, errors.Errorf("Unknown codec `%s`", id)
+	}
+	return c, nil
+}
+
+// decodeService decodes a service with the codec it was encoded with
+func decodeService(id string, raw []byte) (*registry.Service, error) {
+	service := &registry.Service{}
+	if len(raw) == 0 {
+		return service, nil
+	}
+
+	c, err := getCodecByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Unmarshal(raw, service); err != nil {
+		return nil, errors.Wrapf(err, "Error unmarshaling service with codec `%s`", id)
+	}
+	return service, nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ID() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(s *registry.Service) ([]byte, error) {
+	return msgpack.Marshal(s)
+}
+
+func (msgpackCodec) Unmarshal(b []byte, s *registry.Service) error {
+	return msgpack.Unmarshal(b, s)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(s *registry.Service) ([]byte, error) {
+	return json.Marshal(s)
+}
+
+func (jsonCodec) Unmarshal(b []byte, s *registry.Service) error {
+	return json.Unmarshal(b, s)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ID() string {
+	return "protobuf"
+}
+
+func (protobufCodec) Marshal(s *registry.Service) ([]byte, error) {
+	record := &ServiceRecord{
+		Name:      s.Name,
+		Version:   s.Version,
+		Metadata:  s.Metadata,
+		Endpoints: toEndpointRecords(s.Endpoints),
+		Nodes:     make([]*NodeRecord, 0, len(s.Nodes)),
+	}
+
+	for _, n := range s.Nodes {
+		record.Nodes = append(record.Nodes, &NodeRecord{
+			Id:       n.Id,
+			Address:  n.Address,
+			Port:     int64(n.Port),
+			Metadata: n.Metadata,
+		})
+	}
+
+	return proto.Marshal(record)
+}
+
+func (protobufCodec) Unmarshal(b []byte, s *registry.Service) error {
+	var record ServiceRecord
+	if err := proto.Unmarshal(b, &record); err != nil {
+		return err
+	}
+
+	s.Name = record.Name
+	s.Version = record.Version
+	s.Metadata = record.Metadata
+	s.Endpoints = fromEndpointRecords(record.Endpoints)
+	s.Nodes = make([]*registry.Node, 0, len(record.Nodes))
+
+	for _, n := range record.Nodes {
+		s.Nodes = append(s.Nodes, &registry.Node{
+			Id:       n.Id,
+			Address:  n.Address,
+			Port:     int(n.Port),
+			Metadata: n.Metadata,
+		})
+	}
+
+	return nil
+}
+
+func toEndpointRecords(endpoints []*registry.Endpoint) []*EndpointRecord {
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	records := make([]*EndpointRecord, 0, len(endpoints))
+	for _, e := range endpoints {
+		records = append(records, &EndpointRecord{
+			Name:     e.Name,
+			Request:  toValueRecord(e.Request),
+			Response: toValueRecord(e.Response),
+			Metadata: e.Metadata,
+		})
+	}
+	return records
+}
+
+func fromEndpointRecords(records []*EndpointRecord) []*registry.Endpoint {
+	if len(records) == 0 {
+		return nil
+	}
+
+	endpoints := make([]*registry.Endpoint, 0, len(records))
+	for _, e := range records {
+		endpoints = append(endpoints, &registry.Endpoint{
+			Name:     e.Name,
+			Request:  fromValueRecord(e.Request),
+			Response: fromValueRecord(e.Response),
+			Metadata: copyMetadata(e.Metadata),
+		})
+	}
+	return endpoints
+}
+
+func toValueRecord(v *registry.Value) *ValueRecord {
+	if v == nil {
+		return nil
+	}
+
+	record := &ValueRecord{
+		Name: v.Name,
+		Type: v.Type,
+	}
+
+	for _, value := range v.Values {
+		record.Values = append(record.Values, toValueRecord(value))
+	}
+	return record
+}
+
+func fromValueRecord(record *ValueRecord) *registry.Value {
+	if record == nil {
+		return nil
+	}
+
+	v := &registry.Value{
+		Name: record.Name,
+		Type: record.Type,
+	}
+
+	for _, value := range record.Values {
+		v.Values = append(v.Values, fromValueRecord(value))
+	}
+	return v
+}
@@ -0,0 +1,130 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/micro/go-micro/registry"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCodec(t *testing.T) {
+	service := &registry.Service{
+		Name:     "test",
+		Version:  "1.0.0",
+		Metadata: map[string]string{"a": "b"},
+		Endpoints: []*registry.Endpoint{
+			{
+				Name: "Test.Call",
+				Request: &registry.Value{
+					Name: "Request",
+					Type: "Request",
+					Values: []*registry.Value{
+						{Name: "name", Type: "string"},
+					},
+				},
+				Response: &registry.Value{Name: "Response", Type: "Response"},
+				Metadata: map[string]string{"c": "d"},
+			},
+		},
+		Nodes: []*registry.Node{
+			{
+				Id:       "node1",
+				Address:  "127.0.0.1",
+				Port:     123,
+				Metadata: map[string]string{"e": "f"},
+			},
+		},
+	}
+
+	for _, codec := range []Codec{MsgpackCodec, ProtobufCodec, JSONCodec} {
+		Convey("Given the "+codec.ID()+" codec", t, func() {
+			Convey("When a service is encoded and decoded", func() {
+				raw, err := codec.Marshal(service)
+				So(err, ShouldBeNil)
+
+				decoded, err := decodeService(codec.ID(), raw)
+				So(err, ShouldBeNil)
+
+				Convey("Then it should be unchanged", func() {
+					So(decoded, ShouldResemble, service)
+				})
+			})
+		})
+	}
+
+	Convey("Given a service encoded with an unknown codec", t, func() {
+		_, err := decodeService("unknown", []byte{1})
+
+		Convey("Then decoding should fail", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given members using different codecs", t, func() {
+		json := NewIndex()
+		msgpack := NewIndex()
+
+		ctx := WithLegacyPayload(nil, true)
+
+		_, change, err := json.Add(WithCodec(ctx, JSONCodec), copyService(service), 0)
+		So(err, ShouldBeNil)
+
+		// Members of older releases only send the encoded service
+		change.Services["test"].Services["1.0.0"].Structured = false
+
+		Convey("When a change is merged", func() {
+			diff, err := msgpack.Merge(WithCodec(ctx, MsgpackCodec), change)
+			So(err, ShouldBeNil)
+
+			Convey("Then the service should be decoded", func() {
+				So(diff, ShouldHaveLength, 1)
+				So(diff[0].Service, ShouldResemble, service)
+			})
+
+			Convey("Then the service should be stored with the local codec", func() {
+				So(msgpack.GetService("test", "1.0.0").Codec, ShouldEqual, MsgpackCodec.ID())
+
+				m, err := msgpack.ToMap()
+				So(err, ShouldBeNil)
+				So(m["test"], ShouldResemble, []*registry.Service{service})
+			})
+		})
+	})
+
+	Convey("Given a state with the default options", t, WithState(func(s *State) {
+		So(s.Register(copyService(service)), ShouldBeNil)
+
+		Convey("Then services should be readable by members of older releases", func() {
+			stored := s.index.GetService("test", "1.0.0")
+			So(stored.Raw, ShouldNotBeEmpty)
+
+			decoded, err := decodeService(stored.Codec, stored.Raw)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, service)
+		})
+
+		Convey("Then modifying a returned service should not modify the index", func() {
+			services, err := s.GetService("test")
+			So(err, ShouldBeNil)
+
+			services[0].Metadata["a"] = "changed"
+			services[0].Endpoints[0].Metadata["c"] = "changed"
+			services[0].Nodes[0].Metadata["e"] = "changed"
+
+			stored := s.index.GetService("test", "1.0.0")
+			So(stored.registryService("test", "1.0.0"), ShouldResemble, service)
+		})
+	}))
+
+	Convey("Given a state with a payload codec", t, WithState(func(s *State) {
+		So(s.Register(copyService(service)), ShouldBeNil)
+
+		Convey("When the nodes of its owner are disabled", func() {
+			So(s.DisableOwner("member1"), ShouldBeNil)
+
+			Convey("Then the service should be encoded with the codec", func() {
+				So(s.index.GetService("test", "1.0.0").Codec, ShouldEqual, JSONCodec.ID())
+			})
+		})
+	}, PayloadCodec(JSONCodec), Owner("member1")))
+}
@@ -0,0 +1,161 @@
+package state
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"sort"
+)
+
+// Digest returns a digest of the index, services with the same hash on two
+// members do not need to be exchanged
+func (i *Index) Digest() *Digest {
+	digest := &Digest{
+		Services: make(map[string]uint64, len(i.Services)),
+	}
+
+	for name, services := range i.Services {
+		digest.Services[name] = services.hash()
+	}
+
+	return digest
+}
+
+// Delta returns the part of the index that differs from the digest, nil is
+// returned if nothing differs. Services missing from the index are left out,
+// the member holding them sends them when it compares our digest
+func (i *Index) Delta(digest *Digest) *Index {
+	var delta *Index
+
+	for name, services := range i.Services {
+		if h, ok := digest.Services[name]; ok && h == services.hash() {
+			continue
+		}
+
+		if delta == nil {
+			delta = NewIndex()
+		}
+		delta.Services[name] = services
+	}
+
+	return delta
+}
+
+// hash hashes every version of a service in a stable order. The encoded
+// service is left out, codecs may write map keys in any order so members
+// holding the same service would never agree
+func (s *Services) hash() uint64 {
+	h := fnv.New64a()
+
+	for _, version := range sortedKeys(s.Services) {
+		service := s.Services[version]
+
+		writeString(h, version)
+		writeInt(h, service.Mod)
+		writeString(h, service.Origin)
+		writeMap(h, service.Metadata)
+		writeEndpoints(h, service.Endpoints)
+
+		ids := make([]string, 0, len(service.Nodes))
+		for id := range service.Nodes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			node := service.Nodes[id]
+
+			writeString(h, id)
+			writeInt(h, node.Mod)
+			writeInt(h, node.Expiry)
+			writeString(h, node.Owner)
+			writeString(h, node.Origin)
+			writeString(h, node.Address)
+			writeInt(h, node.Port)
+			writeMap(h, node.Metadata)
+			if node.Enabled {
+				h.Write([]byte{1})
+			} else {
+				h.Write([]byte{0})
+			}
+		}
+
+		compacted := make([]string, 0, len(service.Compacted))
+		for id := range service.Compacted {
+			compacted = append(compacted, id)
+		}
+		sort.Strings(compacted)
+
+		for _, id := range compacted {
+			writeString(h, id)
+			writeInt(h, service.Compacted[id])
+		}
+	}
+
+	return h.Sum64()
+}
+
+func sortedKeys(m map[string]*Service) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeEndpoints(h hash.Hash64, endpoints []*EndpointRecord) {
+	writeInt(h, int64(len(endpoints)))
+	for _, e := range endpoints {
+		writeString(h, e.Name)
+		writeValue(h, e.Request)
+		writeValue(h, e.Response)
+		writeMap(h, e.Metadata)
+	}
+}
+
+func writeValue(h hash.Hash64, v *ValueRecord) {
+	if v == nil {
+		writeInt(h, -1)
+		return
+	}
+
+	writeString(h, v.Name)
+	writeString(h, v.Type)
+	writeInt(h, int64(len(v.Values)))
+	for _, value := range v.Values {
+		writeValue(h, value)
+	}
+}
+
+// writeMap writes a map in key order
+func writeMap(h hash.Hash64, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	writeInt(h, int64(len(keys)))
+	for _, k := range keys {
+		writeString(h, k)
+		writeString(h, m[k])
+	}
+}
+
+func writeInt(h hash.Hash64, v int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	h.Write(buf[:])
+}
+
+// writeString writes a length prefixed string so adjacent fields cannot
+// collide
+func writeString(h hash.Hash64, s string) {
+	writeBytes(h, []byte(s))
+}
+
+func writeBytes(h hash.Hash64, b []byte) {
+	writeInt(h, int64(len(b)))
+	h.Write(b)
+}
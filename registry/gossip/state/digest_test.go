@@ -0,0 +1,142 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/micro/go-micro/registry"
+	"github.com/micro/protobuf/proto"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDigest(t *testing.T) {
+	Convey("Given two members with the same services", t, func() {
+		local := NewIndex()
+
+		for _, name := range []string{"test1", "test2"} {
+			_, _, err := local.Add(nil, &registry.Service{
+				Name: name,
+				Nodes: []*registry.Node{
+					{
+						Id:      "node1",
+						Address: "127.0.0.1",
+						Port:    123,
+					},
+				},
+			}, 0)
+			So(err, ShouldBeNil)
+		}
+
+		remote := copyIndex(local)
+
+		Convey("Then the delta should be empty", func() {
+			So(local.Delta(remote.Digest()), ShouldBeNil)
+		})
+
+		Convey("When a service changes on one member", func() {
+			_, _, err := local.Remove(nil, &registry.Service{
+				Name: "test2",
+				Nodes: []*registry.Node{
+					{
+						Id: "node1",
+					},
+				},
+			})
+			So(err, ShouldBeNil)
+
+			Convey("Then the delta should only contain that service", func() {
+				delta := local.Delta(remote.Digest())
+				So(delta, ShouldNotBeNil)
+				So(delta.Services, ShouldHaveLength, 1)
+				So(delta.Services, ShouldContainKey, "test2")
+			})
+
+			Convey("Then merging the delta should converge the members", func() {
+				_, err := remote.Merge(nil, local.Delta(remote.Digest()))
+				So(err, ShouldBeNil)
+				So(remote.Digest(), ShouldResemble, local.Digest())
+			})
+		})
+
+		Convey("When a service only exists on the other member", func() {
+			_, _, err := remote.Add(nil, &registry.Service{
+				Name: "test3",
+			}, 0)
+			So(err, ShouldBeNil)
+
+			Convey("Then it should be left out of the delta", func() {
+				So(local.Delta(remote.Digest()), ShouldBeNil)
+			})
+
+			Convey("Then the other member should send it", func() {
+				delta := remote.Delta(local.Digest())
+				So(delta, ShouldNotBeNil)
+				So(delta.Services, ShouldHaveLength, 1)
+				So(delta.Services, ShouldContainKey, "test3")
+			})
+		})
+	})
+
+	Convey("Given two members that merged a service with several metadata keys", t, func() {
+		metadata := map[string]string{
+			"region": "eu-west-1",
+			"zone":   "eu-west-1a",
+			"weight": "10",
+			"team":   "platform",
+		}
+
+		_, change, err := NewIndex().Add(nil, &registry.Service{
+			Name:     "test",
+			Metadata: metadata,
+			Nodes: []*registry.Node{
+				{
+					Id:       "node1",
+					Address:  "127.0.0.1",
+					Port:     123,
+					Metadata: metadata,
+				},
+			},
+		}, 0)
+		So(err, ShouldBeNil)
+
+		local := NewIndex()
+		remote := NewIndex()
+		for n := 0; n < 10; n++ {
+			_, err = local.Merge(nil, copyIndex(change))
+			So(err, ShouldBeNil)
+			_, err = remote.Merge(nil, copyIndex(change))
+			So(err, ShouldBeNil)
+		}
+
+		Convey("Then the delta should be empty", func() {
+			So(local.Delta(remote.Digest()), ShouldBeNil)
+		})
+	})
+
+	Convey("Given a marshaled digest", t, func() {
+		digest := NewIndex().Digest()
+		digest.From = "member1"
+
+		byt, err := proto.Marshal(digest)
+		So(err, ShouldBeNil)
+
+		Convey("Then it should parse as a digest", func() {
+			parsed, ok := ParseDigest(byt)
+			So(ok, ShouldBeTrue)
+			So(parsed.From, ShouldEqual, "member1")
+		})
+	})
+
+	Convey("Given a marshaled full state", t, func() {
+		i := NewIndex()
+		_, _, err := i.Add(nil, &registry.Service{Name: "test"}, 0)
+		So(err, ShouldBeNil)
+
+		byt, err := proto.Marshal(i)
+		So(err, ShouldBeNil)
+
+		Convey("Then it should not parse as a digest", func() {
+			_, ok := ParseDigest(byt)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,232 @@
+package state
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/micro/go-micro/registry"
+	"github.com/pkg/errors"
+)
+
+// exportDocument is the JSON document written by Export
+type exportDocument struct {
+	Services []*exportService `json:"services"`
+}
+
+// exportService is a service version with its tombstone information and the
+// service it decodes to
+type exportService struct {
+	Name       string            `json:"name"`
+	Version    string            `json:"version"`
+	Mod        int64             `json:"mod"`
+	Origin     string            `json:"origin,omitempty"`
+	Structured bool              `json:"structured"`
+	Codec      string            `json:"codec,omitempty"`
+	Raw        []byte            `json:"raw,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Endpoints  []*EndpointRecord `json:"endpoints,omitempty"`
+	Nodes      []*exportNode     `json:"nodes"`
+	Compacted  map[string]int64  `json:"compacted,omitempty"`
+
+	// Service is the registry service built from the enabled nodes, it is
+	// ignored by Import
+	Service     *registry.Service `json:"service,omitempty"`
+	DecodeError string            `json:"decodeError,omitempty"`
+}
+
+// exportNode is a node with its tombstone information
+type exportNode struct {
+	Id       string            `json:"id"`
+	Mod      int64             `json:"mod"`
+	Expiry   int64             `json:"expiry"`
+	Enabled  bool              `json:"enabled"`
+	Owner    string            `json:"owner,omitempty"`
+	Origin   string            `json:"origin,omitempty"`
+	Address  string            `json:"address,omitempty"`
+	Port     int64             `json:"port,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Export writes the index as an indented JSON document for debugging.
+// Services and nodes are sorted so exports of two members can be diffed
+func (state *State) Export(w io.Writer) error {
+	state.mu.RLock()
+	doc := exportIndex(state.index)
+	state.mu.RUnlock()
+
+	byt, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Error marshaling export")
+	}
+
+	if _, err := w.Write(append(byt, '\n')); err != nil {
+		return errors.Wrap(err, "Error writing export")
+	}
+	return nil
+}
+
+// Import merges a document written by Export into the index, the decoded
+// services in the document are ignored
+func (state *State) Import(r io.Reader) error {
+	byt, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "Error reading import")
+	}
+
+	var doc exportDocument
+	if err := json.Unmarshal(byt, &doc); err != nil {
+		return errors.Wrap(err, "Error unmarshaling import")
+	}
+
+	index, err := importIndex(&doc)
+	if err != nil {
+		return err
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	diff, err := state.index.Merge(state.context(), index)
+	if err != nil {
+		return errors.Wrap(err, "Error merging import")
+	}
+
+	state.apply(diff)
+
+	state.pub(diff)
+
+	return nil
+}
+
+func exportIndex(i *Index) *exportDocument {
+	doc := &exportDocument{
+		Services: []*exportService{},
+	}
+
+	names := make([]string, 0, len(i.Services))
+	for name := range i.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		services := i.Services[name]
+		for _, version := range sortedKeys(services.Services) {
+			doc.Services = append(doc.Services, exportServiceVersion(name, version, services.Services[version]))
+		}
+	}
+
+	return doc
+}
+
+func exportServiceVersion(name string, version string, s *Service) *exportService {
+	e := &exportService{
+		Name:       name,
+		Version:    version,
+		Mod:        s.Mod,
+		Origin:     s.Origin,
+		Structured: s.Structured,
+		Codec:      s.Codec,
+		Raw:        s.Raw,
+		Metadata:   s.Metadata,
+		Endpoints:  s.Endpoints,
+		Nodes:      make([]*exportNode, 0, len(s.Nodes)),
+		Compacted:  s.Compacted,
+	}
+
+	ids := make([]string, 0, len(s.Nodes))
+	for id := range s.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		node := s.Nodes[id]
+		e.Nodes = append(e.Nodes, &exportNode{
+			Id:       id,
+			Mod:      node.Mod,
+			Expiry:   node.Expiry,
+			Enabled:  node.Enabled,
+			Owner:    node.Owner,
+			Origin:   node.Origin,
+			Address:  node.Address,
+			Port:     node.Port,
+			Metadata: node.Metadata,
+		})
+	}
+
+	if s.Structured {
+		e.Service = s.registryService(name, version)
+		return e
+	}
+
+	// Services from older releases are only described by the encoded payload
+	service, err := decodeService(s.Codec, s.Raw)
+	if err != nil {
+		e.DecodeError = err.Error()
+		return e
+	}
+
+	enabled := make(map[string]bool, len(s.Nodes))
+	for id, node := range s.Nodes {
+		if node.Enabled {
+			enabled[id] = true
+		}
+	}
+
+	service.Nodes = filterNodes(service.Nodes, enabled)
+	e.Service = service
+	return e
+}
+
+func importIndex(doc *exportDocument) (*Index, error) {
+	index := NewIndex()
+
+	for _, e := range doc.Services {
+		if e.Name == "" {
+			return nil, errors.New("Imported service is missing a name")
+		}
+
+		services, ok := index.Services[e.Name]
+		if !ok {
+			services = &Services{Services: make(map[string]*Service)}
+			index.Services[e.Name] = services
+		}
+
+		if _, ok := services.Services[e.Version]; ok {
+			return nil, errors.Errorf("Imported service %s version %s is duplicated", e.Name, e.Version)
+		}
+
+		service := &Service{
+			Mod:        e.Mod,
+			Origin:     e.Origin,
+			Structured: e.Structured,
+			Codec:      e.Codec,
+			Raw:        e.Raw,
+			Metadata:   e.Metadata,
+			Endpoints:  e.Endpoints,
+			Nodes:      make(map[string]*Node, len(e.Nodes)),
+			Compacted:  e.Compacted,
+		}
+
+		for _, n := range e.Nodes {
+			service.Nodes[n.Id] = &Node{
+				Mod:      n.Mod,
+				Expiry:   n.Expiry,
+				Enabled:  n.Enabled,
+				Owner:    n.Owner,
+				Origin:   n.Origin,
+				Address:  n.Address,
+				Port:     n.Port,
+				Metadata: n.Metadata,
+			}
+		}
+
+		services.Services[e.Version] = service
+	}
+
+	index.fillMetadata()
+	return index, nil
+}
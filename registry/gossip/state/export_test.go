@@ -0,0 +1,127 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExport(t *testing.T) {
+	Convey("Given a state with a registered and a removed node", t, WithState(func(s1 *State) {
+		service := newService("test")
+		removed := newService("test")
+
+		So(s1.Register(service), ShouldBeNil)
+		So(s1.Register(removed), ShouldBeNil)
+		So(s1.Deregister(removed), ShouldBeNil)
+
+		Convey("When the state is exported", func() {
+			var buf bytes.Buffer
+			So(s1.Export(&buf), ShouldBeNil)
+
+			var doc exportDocument
+			So(json.Unmarshal(buf.Bytes(), &doc), ShouldBeNil)
+
+			Convey("Then the document should hold the service version", func() {
+				So(doc.Services, ShouldHaveLength, 1)
+				So(doc.Services[0].Name, ShouldEqual, "test")
+				So(doc.Services[0].Version, ShouldEqual, "1.0.0")
+			})
+
+			Convey("Then the document should hold both nodes with their tombstone information", func() {
+				nodes := make(map[string]*exportNode)
+				for _, n := range doc.Services[0].Nodes {
+					nodes[n.Id] = n
+				}
+
+				So(nodes, ShouldHaveLength, 2)
+				So(nodes[service.Nodes[0].Id].Enabled, ShouldBeTrue)
+				So(nodes[removed.Nodes[0].Id].Enabled, ShouldBeFalse)
+				So(nodes[removed.Nodes[0].Id].Mod, ShouldBeGreaterThan, nodes[service.Nodes[0].Id].Mod)
+			})
+
+			Convey("Then the decoded service should only hold the enabled node", func() {
+				So(doc.Services[0].Service, ShouldNotBeNil)
+				So(doc.Services[0].Service.Nodes, ShouldHaveLength, 1)
+				So(doc.Services[0].Service.Nodes[0].Id, ShouldEqual, service.Nodes[0].Id)
+			})
+
+			Convey("And it is imported into another state", WithState(func(s2 *State) {
+				So(s2.Import(&buf), ShouldBeNil)
+
+				Convey("Then the service should be available", func() {
+					services, err := s2.GetService("test")
+					So(err, ShouldBeNil)
+					So(services, ShouldHaveLength, 1)
+					So(services[0].Nodes, ShouldHaveLength, 1)
+					So(services[0].Nodes[0].Id, ShouldEqual, service.Nodes[0].Id)
+				})
+
+				Convey("Then the removed node should stay removed after merging the original state", func() {
+					byt, err := s1.LocalState()
+					So(err, ShouldBeNil)
+					So(s2.MergeRemote(byt), ShouldBeNil)
+
+					services, err := s2.GetService("test")
+					So(err, ShouldBeNil)
+					So(services[0].Nodes, ShouldHaveLength, 1)
+				})
+			}))
+		})
+	}))
+
+	Convey("Given a state with a legacy payload", t, WithState(func(s1 *State) {
+		service := newService("test")
+		So(s1.Register(service), ShouldBeNil)
+
+		Convey("When the state is exported and imported", func() {
+			var buf bytes.Buffer
+			So(s1.Export(&buf), ShouldBeNil)
+
+			var doc exportDocument
+			So(json.Unmarshal(buf.Bytes(), &doc), ShouldBeNil)
+
+			Convey("Then the document should hold the payload", func() {
+				So(doc.Services[0].Codec, ShouldEqual, JSONCodec.ID())
+				So(doc.Services[0].Raw, ShouldNotBeEmpty)
+			})
+
+			Convey("Then a service from an older release should be decoded from the payload", func() {
+				service := s1.index.GetService("test", "1.0.0")
+				old := *service
+				old.Structured = false
+				old.Metadata = nil
+				old.Endpoints = nil
+
+				e := exportServiceVersion("test", "1.0.0", &old)
+				So(e.DecodeError, ShouldBeEmpty)
+				So(e.Service, ShouldNotBeNil)
+				So(e.Service.Name, ShouldEqual, "test")
+				So(e.Service.Nodes, ShouldHaveLength, 1)
+			})
+
+			Convey("Then the imported service should be available", WithState(func(s2 *State) {
+				So(s2.Import(&buf), ShouldBeNil)
+
+				services, err := s2.GetService("test")
+				So(err, ShouldBeNil)
+				So(services, ShouldHaveLength, 1)
+				So(services[0].Nodes, ShouldHaveLength, 1)
+			}))
+		})
+	}, LegacyPayload(true), PayloadCodec(JSONCodec)))
+
+	Convey("Given an invalid document", t, WithState(func(s *State) {
+		Convey("Then importing it should fail", func() {
+			So(s.Import(strings.NewReader("{")), ShouldNotBeNil)
+			So(s.Import(strings.NewReader(`{"services":[{"version":"1"}]}`)), ShouldNotBeNil)
+
+			services, err := s.ListServices()
+			So(err, ShouldBeNil)
+			So(services, ShouldBeEmpty)
+		})
+	}))
+}
@@ -0,0 +1,248 @@
+package state
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/micro/go-micro/registry"
+	"github.com/pkg/errors"
+)
+
+// WatchOption configures a watcher created with WatchWith
+type WatchOption func(*watchOptions)
+
+type watchOptions struct {
+	names    []string
+	version  *string
+	metadata map[string]string
+	snapshot bool
+	since    *uint64
+}
+
+// WatchServices only sends results for the named services to the watcher
+func WatchServices(names ...string) WatchOption {
+	return func(o *watchOptions) {
+		o.names = append(o.names, names...)
+	}
+}
+
+// WatchVersion only sends results for service versions matching the
+// constraint to the watcher. A constraint is a comma separated list of
+// comparisons that must all match, such as ">=1.2, <2". Comparisons use one of
+// =, !=, >, >=, < or <=, with = assumed when none is given. Versions are
+// compared by their dot separated parts, numerically where both parts are
+// numbers. A trailing * or x matches any remaining parts, as in "1.x"
+func WatchVersion(constraint string) WatchOption {
+	return func(o *watchOptions) {
+		o.version = &constraint
+	}
+}
+
+// WatchMetadata only sends results for services whose metadata contains every
+// key and value of the selector to the watcher
+func WatchMetadata(selector map[string]string) WatchOption {
+	return func(o *watchOptions) {
+		o.metadata = selector
+	}
+}
+
+// filter decides which results are sent to a watcher
+type filter struct {
+	names    map[string]bool
+	versions []comparison
+	metadata map[string]string
+}
+
+// newFilter creates a filter from watch options, nil is returned if the
+// options do not filter anything
+func newFilter(options watchOptions) (*filter, error) {
+	f := &filter{}
+	empty := true
+
+	if options.version != nil {
+		versions, err := parseConstraint(*options.version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error parsing version constraint `%s`", *options.version)
+		}
+		f.versions = versions
+		empty = false
+	}
+
+	if options.metadata != nil {
+		f.metadata = options.metadata
+		empty = false
+	}
+
+	if len(options.names) != 0 {
+		f.names = make(map[string]bool, len(options.names))
+		for _, name := range options.names {
+			f.names[name] = true
+		}
+		empty = false
+	}
+
+	if empty {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// change returns the change as the watcher should see it, nil if the watcher
+// should not see it. An update that moves a service out of the filter is sent
+// as a delete and one that moves it in is sent as a create
+func (f *filter) change(c *Change) *Change {
+	if f == nil || c.Action != "update" || c.Previous == nil {
+		if f.match(c.Service) {
+			return c
+		}
+		return nil
+	}
+
+	was, is := f.match(c.Previous), f.match(c.Service)
+
+	switch {
+	case was && is:
+		return c
+	case was:
+		return &Change{
+			Result: &registry.Result{
+				Action:  "delete",
+				Service: c.Previous,
+			},
+			Previous: c.Previous,
+			Removed:  c.Previous.Nodes,
+		}
+	case is:
+		return &Change{
+			Result: &registry.Result{
+				Action:  "create",
+				Service: c.Service,
+			},
+			Added: c.Service.Nodes,
+		}
+	}
+	return nil
+}
+
+// match checks if a service passes the filter
+func (f *filter) match(s *registry.Service) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.names != nil && !f.names[s.Name] {
+		return false
+	}
+
+	for _, c := range f.versions {
+		if !c.match(s.Version) {
+			return false
+		}
+	}
+
+	for k, v := range f.metadata {
+		if value, ok := s.Metadata[k]; !ok || value != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// comparison is a single part of a version constraint
+type comparison struct {
+	op      string
+	version []string
+}
+
+var operators = []string{">=", "<=", "!=", ">", "<", "="}
+
+func parseConstraint(constraint string) ([]comparison, error) {
+	var comparisons []comparison
+
+	for _, part := range strings.Split(constraint, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, errors.New("Empty comparison")
+		}
+
+		op := "="
+		for _, o := range operators {
+			if strings.HasPrefix(part, o) {
+				op = o
+				part = strings.TrimSpace(part[len(o):])
+				break
+			}
+		}
+
+		if part == "" {
+			return nil, errors.Errorf("Missing version after `%s`", op)
+		}
+
+		comparisons = append(comparisons, comparison{
+			op:      op,
+			version: strings.Split(part, "."),
+		})
+	}
+
+	return comparisons, nil
+}
+
+func (c comparison) match(version string) bool {
+	cmp := compareVersions(strings.Split(version, "."), c.version)
+
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	default:
+		return cmp == 0
+	}
+}
+
+// compareVersions compares two versions part by part, a wildcard in b matches
+// the rest of a. Missing parts compare as zero
+func compareVersions(a []string, b []string) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		p1, p2 := "0", "0"
+		if i < len(a) {
+			p1 = a[i]
+		}
+		if i < len(b) {
+			p2 = b[i]
+		}
+
+		if p2 == "*" || p2 == "x" {
+			return 0
+		}
+
+		if c := comparePart(p1, p2); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func comparePart(a string, b string) int {
+	n1, err1 := strconv.Atoi(a)
+	n2, err2 := strconv.Atoi(b)
+
+	if err1 == nil && err2 == nil {
+		switch {
+		case n1 < n2:
+			return -1
+		case n1 > n2:
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(a, b)
+}
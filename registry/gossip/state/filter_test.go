@@ -0,0 +1,49 @@
+package state
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVersionConstraint(t *testing.T) {
+	Convey("Given version constraints", t, func() {
+		cases := []struct {
+			constraint string
+			version    string
+			match      bool
+		}{
+			{"1.0.0", "1.0.0", true},
+			{"1.0", "1.0.0", true},
+			{"=1.0.0", "1.0.1", false},
+			{"!=1.0.0", "1.0.1", true},
+			{">1.9", "1.10", true},
+			{"<1.9", "1.10", false},
+			{">=1.2, <2", "1.5.0", true},
+			{">=1.2, <2", "2.0.0", false},
+			{"1.x", "1.7.3", true},
+			{"1.*", "2.0.0", false},
+			{">=1.0.0", "latest", true},
+		}
+
+		for _, c := range cases {
+			Convey("Then "+c.constraint+" should match "+c.version+" correctly", func() {
+				comparisons, err := parseConstraint(c.constraint)
+				So(err, ShouldBeNil)
+
+				match := true
+				for _, comparison := range comparisons {
+					match = match && comparison.match(c.version)
+				}
+				So(match, ShouldEqual, c.match)
+			})
+		}
+
+		Convey("Then invalid constraints should return an error", func() {
+			for _, c := range []string{"", ">=", "1.0,,2.0"} {
+				_, err := parseConstraint(c)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
@@ -0,0 +1,65 @@
+package state
+
+// revision is a published change and its revision
+type revision struct {
+	revision uint64
+	change   *Change
+}
+
+// history is a ring buffer of the most recently published results
+type history struct {
+	entries []revision
+	start   int
+	count   int
+}
+
+func newHistory(size int) *history {
+	if size < 0 {
+		size = 0
+	}
+
+	return &history{
+		entries: make([]revision, size),
+	}
+}
+
+// add records a result, the oldest result is overwritten once full
+func (h *history) add(rev uint64, c *Change) {
+	if len(h.entries) == 0 {
+		return
+	}
+
+	i := (h.start + h.count) % len(h.entries)
+	h.entries[i] = revision{revision: rev, change: c}
+
+	if h.count < len(h.entries) {
+		h.count++
+	} else {
+		h.start = (h.start + 1) % len(h.entries)
+	}
+}
+
+// since returns the results published after rev, false is returned if some
+// of them are no longer held. current is the latest published revision
+func (h *history) since(rev uint64, current uint64) ([]revision, bool) {
+	if rev > current {
+		return nil, false
+	}
+
+	if rev == current {
+		return nil, true
+	}
+
+	if h.count == 0 || h.entries[h.start].revision > rev+1 {
+		return nil, false
+	}
+
+	res := make([]revision, 0, current-rev)
+	for i := 0; i < h.count; i++ {
+		e := h.entries[(h.start+i)%len(h.entries)]
+		if e.revision > rev {
+			res = append(res, e)
+		}
+	}
+	return res, true
+}
@@ -0,0 +1,57 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/micro/go-micro/registry"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHistory(t *testing.T) {
+	Convey("Given a history of three results", t, func() {
+		h := newHistory(3)
+
+		Convey("When five results are added", func() {
+			for i := uint64(1); i <= 5; i++ {
+				h.add(i, &Change{Result: &registry.Result{Action: "create"}})
+			}
+
+			Convey("Then results since a held revision should be returned in order", func() {
+				res, ok := h.since(2, 5)
+				So(ok, ShouldBeTrue)
+				So(res, ShouldHaveLength, 3)
+				So(res[0].revision, ShouldEqual, 3)
+				So(res[2].revision, ShouldEqual, 5)
+			})
+
+			Convey("Then results since the latest revision should be empty", func() {
+				res, ok := h.since(5, 5)
+				So(ok, ShouldBeTrue)
+				So(res, ShouldBeEmpty)
+			})
+
+			Convey("Then results since an overwritten revision should not be returned", func() {
+				_, ok := h.since(1, 5)
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Then results since a future revision should not be returned", func() {
+				_, ok := h.since(6, 5)
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Given a disabled history", t, func() {
+		h := newHistory(0)
+		h.add(1, &Change{Result: &registry.Result{Action: "create"}})
+
+		Convey("Then only the latest revision should be resumable", func() {
+			_, ok := h.since(0, 1)
+			So(ok, ShouldBeFalse)
+
+			_, ok = h.since(1, 1)
+			So(ok, ShouldBeTrue)
+		})
+	})
+}
@@ -6,13 +6,20 @@
 Package state is a generated protocol buffer package.
 
 It is generated from these files:
+
 	index.proto
 
 It has these top-level messages:
+
 	Node
 	Service
 	Services
 	Index
+	Digest
+	ServiceRecord
+	NodeRecord
+	EndpointRecord
+	ValueRecord
 */
 package state
 
@@ -32,9 +39,14 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type Node struct {
-	Mod     int64 `protobuf:"varint,1,opt,name=Mod,json=mod" json:"Mod,omitempty"`
-	Expiry  int64 `protobuf:"varint,2,opt,name=Expiry,json=expiry" json:"Expiry,omitempty"`
-	Enabled bool  `protobuf:"varint,3,opt,name=Enabled,json=enabled" json:"Enabled,omitempty"`
+	Mod      int64             `protobuf:"varint,1,opt,name=Mod,json=mod" json:"Mod,omitempty"`
+	Expiry   int64             `protobuf:"varint,2,opt,name=Expiry,json=expiry" json:"Expiry,omitempty"`
+	Enabled  bool              `protobuf:"varint,3,opt,name=Enabled,json=enabled" json:"Enabled,omitempty"`
+	Owner    string            `protobuf:"bytes,4,opt,name=Owner,json=owner" json:"Owner,omitempty"`
+	Origin   string            `protobuf:"bytes,5,opt,name=Origin,json=origin" json:"Origin,omitempty"`
+	Address  string            `protobuf:"bytes,6,opt,name=Address,json=address" json:"Address,omitempty"`
+	Port     int64             `protobuf:"varint,7,opt,name=Port,json=port" json:"Port,omitempty"`
+	Metadata map[string]string `protobuf:"bytes,8,rep,name=Metadata,json=metadata" json:"Metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
 }
 
 func (m *Node) Reset()                    { *m = Node{} }
@@ -42,10 +54,27 @@ func (m *Node) String() string            { return proto.CompactTextString(m) }
 func (*Node) ProtoMessage()               {}
 func (*Node) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
 
+func (m *Node) GetMetadata() map[string]string {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
 type Service struct {
-	Mod   int64            `protobuf:"varint,1,opt,name=Mod,json=mod" json:"Mod,omitempty"`
-	Nodes map[string]*Node `protobuf:"bytes,2,rep,name=Nodes,json=nodes" json:"Nodes,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
-	Raw   []byte           `protobuf:"bytes,3,opt,name=Raw,json=raw,proto3" json:"Raw,omitempty"`
+	Mod       int64             `protobuf:"varint,1,opt,name=Mod,json=mod" json:"Mod,omitempty"`
+	Nodes     map[string]*Node  `protobuf:"bytes,2,rep,name=Nodes,json=nodes" json:"Nodes,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Raw       []byte            `protobuf:"bytes,3,opt,name=Raw,json=raw,proto3" json:"Raw,omitempty"`
+	Origin    string            `protobuf:"bytes,4,opt,name=Origin,json=origin" json:"Origin,omitempty"`
+	Codec     string            `protobuf:"bytes,5,opt,name=Codec,json=codec" json:"Codec,omitempty"`
+	Metadata  map[string]string `protobuf:"bytes,6,rep,name=Metadata,json=metadata" json:"Metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Endpoints []*EndpointRecord `protobuf:"bytes,7,rep,name=Endpoints,json=endpoints" json:"Endpoints,omitempty"`
+	// Structured is set when the fields above are populated, services from
+	// members that only send Raw are decoded from it instead
+	Structured bool `protobuf:"varint,8,opt,name=Structured,json=structured" json:"Structured,omitempty"`
+	// Compacted holds the modification time of compacted tombstones by node
+	// id, copies of the nodes that are not newer are not merged
+	Compacted map[string]int64 `protobuf:"bytes,9,rep,name=Compacted,json=compacted" json:"Compacted,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
 }
 
 func (m *Service) Reset()                    { *m = Service{} }
@@ -60,6 +89,27 @@ func (m *Service) GetNodes() map[string]*Node {
 	return nil
 }
 
+func (m *Service) GetMetadata() map[string]string {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+func (m *Service) GetEndpoints() []*EndpointRecord {
+	if m != nil {
+		return m.Endpoints
+	}
+	return nil
+}
+
+func (m *Service) GetCompacted() map[string]int64 {
+	if m != nil {
+		return m.Compacted
+	}
+	return nil
+}
+
 type Services struct {
 	Services map[string]*Service `protobuf:"bytes,1,rep,name=Services,json=services" json:"Services,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
 }
@@ -92,32 +142,187 @@ func (m *Index) GetServices() map[string]*Services {
 	return nil
 }
 
+// Digest summarises an index with a hash per service name. Its field numbers
+// do not overlap with Index so either message decodes as empty as the other
+type Digest struct {
+	From     string            `protobuf:"bytes,2,opt,name=From,json=from" json:"From,omitempty"`
+	Services map[string]uint64 `protobuf:"bytes,3,rep,name=Services,json=services" json:"Services,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+}
+
+func (m *Digest) Reset()                    { *m = Digest{} }
+func (m *Digest) String() string            { return proto.CompactTextString(m) }
+func (*Digest) ProtoMessage()               {}
+func (*Digest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *Digest) GetServices() map[string]uint64 {
+	if m != nil {
+		return m.Services
+	}
+	return nil
+}
+
+// ServiceRecord is the registry service encoded by the protobuf codec
+type ServiceRecord struct {
+	Name      string            `protobuf:"bytes,1,opt,name=Name,json=name" json:"Name,omitempty"`
+	Version   string            `protobuf:"bytes,2,opt,name=Version,json=version" json:"Version,omitempty"`
+	Metadata  map[string]string `protobuf:"bytes,3,rep,name=Metadata,json=metadata" json:"Metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Endpoints []*EndpointRecord `protobuf:"bytes,4,rep,name=Endpoints,json=endpoints" json:"Endpoints,omitempty"`
+	Nodes     []*NodeRecord     `protobuf:"bytes,5,rep,name=Nodes,json=nodes" json:"Nodes,omitempty"`
+}
+
+func (m *ServiceRecord) Reset()                    { *m = ServiceRecord{} }
+func (m *ServiceRecord) String() string            { return proto.CompactTextString(m) }
+func (*ServiceRecord) ProtoMessage()               {}
+func (*ServiceRecord) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *ServiceRecord) GetMetadata() map[string]string {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+func (m *ServiceRecord) GetEndpoints() []*EndpointRecord {
+	if m != nil {
+		return m.Endpoints
+	}
+	return nil
+}
+
+func (m *ServiceRecord) GetNodes() []*NodeRecord {
+	if m != nil {
+		return m.Nodes
+	}
+	return nil
+}
+
+type NodeRecord struct {
+	Id       string            `protobuf:"bytes,1,opt,name=Id,json=id" json:"Id,omitempty"`
+	Address  string            `protobuf:"bytes,2,opt,name=Address,json=address" json:"Address,omitempty"`
+	Port     int64             `protobuf:"varint,3,opt,name=Port,json=port" json:"Port,omitempty"`
+	Metadata map[string]string `protobuf:"bytes,4,rep,name=Metadata,json=metadata" json:"Metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *NodeRecord) Reset()                    { *m = NodeRecord{} }
+func (m *NodeRecord) String() string            { return proto.CompactTextString(m) }
+func (*NodeRecord) ProtoMessage()               {}
+func (*NodeRecord) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *NodeRecord) GetMetadata() map[string]string {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+type EndpointRecord struct {
+	Name     string            `protobuf:"bytes,1,opt,name=Name,json=name" json:"Name,omitempty"`
+	Request  *ValueRecord      `protobuf:"bytes,2,opt,name=Request,json=request" json:"Request,omitempty"`
+	Response *ValueRecord      `protobuf:"bytes,3,opt,name=Response,json=response" json:"Response,omitempty"`
+	Metadata map[string]string `protobuf:"bytes,4,rep,name=Metadata,json=metadata" json:"Metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *EndpointRecord) Reset()                    { *m = EndpointRecord{} }
+func (m *EndpointRecord) String() string            { return proto.CompactTextString(m) }
+func (*EndpointRecord) ProtoMessage()               {}
+func (*EndpointRecord) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *EndpointRecord) GetRequest() *ValueRecord {
+	if m != nil {
+		return m.Request
+	}
+	return nil
+}
+
+func (m *EndpointRecord) GetResponse() *ValueRecord {
+	if m != nil {
+		return m.Response
+	}
+	return nil
+}
+
+func (m *EndpointRecord) GetMetadata() map[string]string {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+type ValueRecord struct {
+	Name   string         `protobuf:"bytes,1,opt,name=Name,json=name" json:"Name,omitempty"`
+	Type   string         `protobuf:"bytes,2,opt,name=Type,json=type" json:"Type,omitempty"`
+	Values []*ValueRecord `protobuf:"bytes,3,rep,name=Values,json=values" json:"Values,omitempty"`
+}
+
+func (m *ValueRecord) Reset()                    { *m = ValueRecord{} }
+func (m *ValueRecord) String() string            { return proto.CompactTextString(m) }
+func (*ValueRecord) ProtoMessage()               {}
+func (*ValueRecord) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+func (m *ValueRecord) GetValues() []*ValueRecord {
+	if m != nil {
+		return m.Values
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Node)(nil), "state.Node")
 	proto.RegisterType((*Service)(nil), "state.Service")
 	proto.RegisterType((*Services)(nil), "state.Services")
 	proto.RegisterType((*Index)(nil), "state.Index")
+	proto.RegisterType((*Digest)(nil), "state.Digest")
+	proto.RegisterType((*ServiceRecord)(nil), "state.ServiceRecord")
+	proto.RegisterType((*NodeRecord)(nil), "state.NodeRecord")
+	proto.RegisterType((*EndpointRecord)(nil), "state.EndpointRecord")
+	proto.RegisterType((*ValueRecord)(nil), "state.ValueRecord")
 }
 
 var fileDescriptor0 = []byte{
-	// 291 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x84, 0x92, 0xcb, 0x4a, 0xc4, 0x30,
-	0x18, 0x85, 0xc9, 0xc4, 0x5e, 0xfc, 0xeb, 0x8d, 0x2c, 0xa4, 0x16, 0x04, 0x2d, 0x0a, 0xb3, 0xaa,
-	0x30, 0x82, 0xa8, 0xfb, 0x2e, 0xbc, 0x2e, 0xe2, 0x13, 0x64, 0x4c, 0x16, 0xc5, 0xb1, 0x19, 0x92,
-	0x3a, 0x33, 0x7d, 0x08, 0x37, 0xbe, 0x83, 0xef, 0x69, 0x93, 0x06, 0x67, 0xa2, 0x23, 0xee, 0xce,
-	0xdf, 0xd3, 0xff, 0x9c, 0x2f, 0x24, 0x90, 0x54, 0x35, 0x17, 0x8b, 0x62, 0xaa, 0x64, 0x23, 0x49,
-	0xa0, 0x1b, 0xd6, 0x88, 0xfc, 0x16, 0x36, 0x1e, 0x25, 0x17, 0x64, 0x0f, 0xf0, 0x83, 0xe4, 0x29,
-	0x3a, 0x42, 0x43, 0x4c, 0xf1, 0xab, 0xe4, 0x64, 0x1f, 0xc2, 0x72, 0x31, 0xad, 0x54, 0x9b, 0x0e,
-	0xec, 0xc7, 0x50, 0xd8, 0x89, 0xa4, 0x10, 0x95, 0x35, 0x1b, 0x4f, 0x04, 0x4f, 0x71, 0x67, 0xc4,
-	0x34, 0x12, 0xfd, 0x98, 0x7f, 0x22, 0x88, 0x9e, 0x84, 0x9a, 0x55, 0xcf, 0xeb, 0xf2, 0xce, 0x20,
-	0x30, 0x4d, 0xba, 0x8b, 0xc3, 0xc3, 0x64, 0x74, 0x50, 0x58, 0x80, 0xc2, 0x2d, 0x14, 0xd6, 0x2b,
-	0xeb, 0x46, 0xb5, 0x34, 0xa8, 0x8d, 0x36, 0x11, 0x94, 0xcd, 0x6d, 0xc9, 0x16, 0xc5, 0x8a, 0xcd,
-	0xb3, 0x12, 0x60, 0xf9, 0x9b, 0xf1, 0x5f, 0x44, 0x6b, 0x2b, 0x36, 0xa9, 0x91, 0xe4, 0x18, 0x82,
-	0x19, 0x9b, 0xbc, 0x09, 0x4b, 0x9c, 0x8c, 0x12, 0x57, 0x61, 0x76, 0x68, 0xef, 0x5c, 0x0f, 0x2e,
-	0x51, 0xfe, 0x81, 0x20, 0x76, 0xb5, 0x9a, 0x5c, 0x2d, 0x75, 0x17, 0x65, 0xc8, 0x0e, 0x7d, 0x32,
-	0xfd, 0x2d, 0x7a, 0xba, 0x58, 0xbb, 0x31, 0xbb, 0x83, 0x6d, 0xcf, 0x5a, 0x43, 0x74, 0xe2, 0x13,
-	0xed, 0xf8, 0xd1, 0xab, 0x50, 0xef, 0x08, 0x82, 0x1b, 0x73, 0x3f, 0xe4, 0xe2, 0x17, 0x51, 0xe6,
-	0xd6, 0xac, 0xff, 0x27, 0xce, 0xfd, 0xff, 0x38, 0xa7, 0x3e, 0xce, 0xee, 0x8f, 0x93, 0xae, 0xf0,
-	0x8c, 0x43, 0xfb, 0x4c, 0xce, 0xbf, 0x02, 0x00, 0x00, 0xff, 0xff, 0x20, 0xa9, 0xce, 0x2f, 0x35,
-	0x02, 0x00, 0x00,
+	// 718 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xb4, 0x96, 0xdf, 0x6f, 0xd3, 0x30,
+	0x10, 0xc7, 0x95, 0xdf, 0xc9, 0x95, 0x15, 0xb0, 0x06, 0x0a, 0xe5, 0x57, 0x19, 0x20, 0x2a, 0x84,
+	0x8a, 0xb4, 0x09, 0x18, 0x14, 0x81, 0xd0, 0x28, 0xd2, 0x04, 0xdb, 0x50, 0x86, 0xf6, 0x9e, 0xd5,
+	0x66, 0x8a, 0x58, 0xe3, 0x60, 0xbb, 0xdb, 0xfa, 0xc6, 0x3f, 0xc0, 0x0b, 0x4f, 0x68, 0x7f, 0x0f,
+	0x7f, 0x18, 0xb2, 0xe3, 0x76, 0x4e, 0x97, 0x6a, 0x93, 0xa6, 0xbd, 0xf9, 0x6c, 0xdf, 0xf9, 0x73,
+	0xdf, 0xcb, 0x9d, 0x02, 0x8d, 0x2c, 0xc7, 0xe4, 0xa8, 0x5b, 0x30, 0x2a, 0x28, 0xf2, 0xb8, 0x48,
+	0x05, 0x59, 0x3a, 0xb6, 0xc1, 0xdd, 0xa4, 0x98, 0xa0, 0x6b, 0xe0, 0x6c, 0x50, 0x1c, 0x5b, 0x6d,
+	0xab, 0xe3, 0x24, 0xce, 0x90, 0x62, 0x74, 0x13, 0xfc, 0xfe, 0x51, 0x91, 0xb1, 0x71, 0x6c, 0xab,
+	0x4d, 0x9f, 0x28, 0x0b, 0xc5, 0x10, 0xf4, 0xf3, 0x74, 0x77, 0x9f, 0xe0, 0xd8, 0x69, 0x5b, 0x9d,
+	0x30, 0x09, 0x48, 0x69, 0xa2, 0x45, 0xf0, 0xb6, 0x0e, 0x73, 0xc2, 0x62, 0xb7, 0x6d, 0x75, 0xa2,
+	0xc4, 0xa3, 0xd2, 0x90, 0x71, 0xb6, 0x58, 0xb6, 0x97, 0xe5, 0xb1, 0xa7, 0xb6, 0x7d, 0xaa, 0x2c,
+	0x19, 0xe7, 0x03, 0xc6, 0x8c, 0x70, 0x1e, 0xfb, 0xea, 0x20, 0x48, 0x4b, 0x13, 0x21, 0x70, 0xbf,
+	0x52, 0x26, 0xe2, 0x40, 0xbd, 0xeb, 0x16, 0x94, 0x09, 0xf4, 0x02, 0xc2, 0x0d, 0x22, 0x52, 0x9c,
+	0x8a, 0x34, 0x0e, 0xdb, 0x4e, 0xa7, 0xb1, 0x7c, 0xab, 0xab, 0x52, 0xe8, 0x4a, 0xfc, 0xee, 0xe4,
+	0xac, 0x9f, 0x0b, 0x36, 0x4e, 0xc2, 0xa1, 0x36, 0x5b, 0x3d, 0x58, 0xa8, 0x1c, 0xc9, 0x3c, 0x7f,
+	0x90, 0xb1, 0xca, 0x33, 0x4a, 0xe4, 0x52, 0x52, 0x1f, 0xa4, 0xfb, 0x23, 0xa2, 0xd2, 0x8c, 0x92,
+	0xd2, 0x78, 0x63, 0xaf, 0x5a, 0x4b, 0xc7, 0x2e, 0x04, 0xdb, 0x84, 0x1d, 0x64, 0x83, 0x3a, 0x7d,
+	0x9e, 0x83, 0x27, 0x9f, 0xe6, 0xb1, 0x5d, 0xc1, 0xd1, 0x0e, 0x0a, 0x8b, 0x97, 0x38, 0x5e, 0x2e,
+	0xd7, 0x32, 0x44, 0x92, 0x1e, 0x2a, 0xd1, 0xae, 0x24, 0x0e, 0x4b, 0x0f, 0x0d, 0x69, 0xdc, 0x8a,
+	0x34, 0x8b, 0xe0, 0xad, 0x51, 0x4c, 0x06, 0x5a, 0x31, 0x6f, 0x20, 0x0d, 0xb4, 0x6a, 0x48, 0xe0,
+	0xab, 0x37, 0xef, 0xcc, 0xbc, 0x39, 0x47, 0x05, 0xb4, 0x02, 0x51, 0x3f, 0xc7, 0x05, 0xcd, 0x72,
+	0xc1, 0xe3, 0x40, 0xb9, 0xde, 0xd0, 0xae, 0x93, 0xfd, 0x84, 0x0c, 0x28, 0xc3, 0x49, 0x44, 0x26,
+	0xf7, 0xd0, 0x3d, 0x80, 0x6d, 0xc1, 0x46, 0x03, 0x31, 0x62, 0x04, 0xc7, 0xa1, 0x2a, 0x35, 0xf0,
+	0xe9, 0x0e, 0xea, 0x41, 0xb4, 0x46, 0x87, 0x45, 0x3a, 0x10, 0x04, 0xc7, 0x91, 0x0a, 0x7a, 0x77,
+	0x86, 0x67, 0x7a, 0x5e, 0x02, 0x45, 0x83, 0x89, 0xdd, 0xea, 0x03, 0x9c, 0x08, 0x54, 0x53, 0x94,
+	0x07, 0x66, 0x51, 0x1a, 0xcb, 0x0d, 0xa3, 0xd6, 0x46, 0x85, 0x2e, 0x54, 0xde, 0xd6, 0x5b, 0x68,
+	0x56, 0x01, 0xcf, 0xf2, 0x76, 0xcc, 0x8f, 0xe3, 0x8f, 0x05, 0xa1, 0xce, 0x93, 0xa3, 0xd7, 0x27,
+	0xeb, 0xd8, 0xaa, 0x93, 0x82, 0x4f, 0x17, 0xba, 0x36, 0x5c, 0x9b, 0xad, 0xcf, 0xb0, 0x50, 0x39,
+	0xaa, 0x81, 0x78, 0x54, 0x15, 0xa3, 0x59, 0x0d, 0x6d, 0x42, 0xfd, 0xb6, 0xc0, 0x5b, 0x97, 0x5d,
+	0x8e, 0x5e, 0x9e, 0x22, 0x6a, 0x69, 0x37, 0x75, 0x3e, 0x17, 0xe7, 0xcb, 0xd9, 0x38, 0x8f, 0xab,
+	0x38, 0x57, 0x67, 0x32, 0x9d, 0x11, 0xc9, 0xff, 0x98, 0xed, 0x11, 0x2e, 0x64, 0x53, 0x7f, 0x62,
+	0x74, 0xa8, 0xcb, 0xe0, 0x7e, 0x67, 0x74, 0x88, 0x5e, 0x19, 0x90, 0x8e, 0x82, 0xbc, 0xad, 0x83,
+	0x95, 0x4e, 0x73, 0x29, 0x7b, 0x67, 0x53, 0x56, 0x2a, 0xe7, 0x9a, 0x50, 0x7f, 0xed, 0xa9, 0x77,
+	0xf9, 0xd5, 0x4b, 0xb6, 0xcd, 0x74, 0x48, 0xb4, 0xbb, 0x9b, 0xa7, 0x43, 0x22, 0xc7, 0xd3, 0x0e,
+	0x61, 0x3c, 0xa3, 0xb9, 0x46, 0x0e, 0x0e, 0x4a, 0x13, 0xbd, 0x33, 0xfa, 0xb0, 0xa4, 0x5e, 0x9a,
+	0xa9, 0x88, 0x8a, 0x7a, 0xbe, 0x6e, 0x74, 0xcf, 0xd9, 0x8d, 0x4f, 0x26, 0xd3, 0xc6, 0x53, 0x0e,
+	0xd7, 0xcd, 0x86, 0x28, 0x2f, 0x97, 0x53, 0xe6, 0x62, 0x13, 0xef, 0x9f, 0x05, 0x70, 0x12, 0x12,
+	0x35, 0xc1, 0x5e, 0xc7, 0xda, 0xd3, 0xce, 0xb0, 0x39, 0xb2, 0xed, 0xfa, 0x91, 0xed, 0x18, 0x23,
+	0xbb, 0x67, 0xe8, 0x54, 0xa6, 0x79, 0xff, 0x14, 0xf5, 0xe5, 0x0c, 0xee, 0x5f, 0x36, 0x34, 0xab,
+	0x52, 0xd6, 0x96, 0xf8, 0x19, 0x04, 0x09, 0xf9, 0x39, 0x22, 0x5c, 0xe8, 0x4f, 0x19, 0x69, 0xbe,
+	0x1d, 0x19, 0x49, 0xcb, 0x1a, 0xb0, 0xf2, 0x0a, 0xea, 0x42, 0x98, 0x10, 0x5e, 0xd0, 0x9c, 0x93,
+	0xd8, 0x99, 0x7b, 0x3d, 0x64, 0xfa, 0x0e, 0x7a, 0x7f, 0x2a, 0xfd, 0x87, 0xb5, 0x55, 0xbe, 0x1c,
+	0x09, 0x52, 0x68, 0x18, 0x58, 0xb5, 0xe9, 0x23, 0x70, 0xbf, 0x8d, 0x8b, 0x89, 0xaf, 0x2b, 0xc6,
+	0x05, 0x41, 0x4f, 0xc1, 0x57, 0x6e, 0x93, 0x7e, 0xac, 0x4b, 0xd1, 0x57, 0xaf, 0xf0, 0x5d, 0x5f,
+	0xfd, 0x49, 0xac, 0xfc, 0x1f, 0x00, 0x84, 0xf7, 0xce, 0x40, 0x58, 0x08, 0x00, 0x00,
 }
@@ -1,13 +1,15 @@
 package state
 
 import (
+	"reflect"
+	"sort"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/ThatsMrTalbot/cluster/clock"
 	"github.com/micro/go-micro/registry"
 	"github.com/pkg/errors"
-	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
 // NewIndex creates a new index
@@ -18,85 +20,88 @@ func NewIndex() *Index {
 }
 
 // Add merges a new service
-func (i *Index) Add(ctx context.Context, s *registry.Service, timeout time.Duration) ([]*registry.Result, *Index, error) {
-	mod := time.Now().UnixNano()
+func (i *Index) Add(ctx context.Context, s *registry.Service, timeout time.Duration) ([]*Change, *Index, error) {
+	mod := getClock(ctx).Now()
 
 	ttl := int64(0)
 	if timeout != 0 {
-		ttl = time.Now().Add(timeout).UnixNano()
+		ttl = getTime(ctx).Now().Add(timeout).UnixNano()
 	}
 
-	raw, err := msgpack.Marshal(s)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "Error marshaling service")
-	}
+	owner := getOwner(ctx)
 
 	nodes := make(map[string]*Node)
 	for _, node := range s.Nodes {
 		nodes[node.Id] = &Node{
-			Enabled: true,
-			Mod:     mod,
-			Expiry:  ttl,
+			Enabled:  true,
+			Mod:      mod,
+			Expiry:   ttl,
+			Owner:    owner,
+			Origin:   owner,
+			Address:  node.Address,
+			Port:     int64(node.Port),
+			Metadata: node.Metadata,
 		}
 	}
 
-	merge := &Index{
-		map[string]*Services{
-			s.Name: {
-				Services: map[string]*Service{
-					s.Version: {
-						Nodes: nodes,
-						Mod:   mod,
-						Raw:   raw,
-					},
-				},
-			},
-		},
-	}
-
-	ctx = withService(ctx, s)
-	diff, err := i.Merge(ctx, merge)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "Error merging merge changes")
-	}
-
-	return diff, merge, nil
+	return i.change(ctx, s, nodes, mod)
 }
 
 // Remove merges a removed service
-func (i *Index) Remove(ctx context.Context, s *registry.Service) ([]*registry.Result, *Index, error) {
-	mod := time.Now().UnixNano()
+func (i *Index) Remove(ctx context.Context, s *registry.Service) ([]*Change, *Index, error) {
+	mod := getClock(ctx).Now()
+	owner := getOwner(ctx)
 
 	nodes := make(map[string]*Node)
 	for _, node := range s.Nodes {
 		nodes[node.Id] = &Node{
 			Enabled: false,
 			Mod:     mod,
+			Owner:   owner,
+			Origin:  owner,
 		}
 	}
 
-	s.Nodes = []*registry.Node{}
+	// Copy the service rather than clearing the nodes of the one passed in
+	c := *s
+	c.Nodes = []*registry.Node{}
 
-	raw, err := msgpack.Marshal(s)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "Error marshaling service")
+	return i.change(ctx, &c, nodes, mod)
+}
+
+// change merges a local change to a service and returns it as an index
+func (i *Index) change(ctx context.Context, s *registry.Service, nodes map[string]*Node, mod int64) ([]*Change, *Index, error) {
+	service := &Service{
+		Mod:        mod,
+		Nodes:      nodes,
+		Origin:     getOwner(ctx),
+		Metadata:   s.Metadata,
+		Endpoints:  toEndpointRecords(s.Endpoints),
+		Structured: true,
+	}
+
+	// Members of older releases only read the encoded service
+	if getLegacyPayload(ctx) {
+		codec := getCodec(ctx)
+		raw, err := codec.Marshal(s)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Error marshaling service")
+		}
+
+		service.Raw = raw
+		service.Codec = codec.ID()
 	}
 
 	merge := &Index{
 		map[string]*Services{
 			s.Name: {
 				Services: map[string]*Service{
-					s.Version: {
-						Nodes: nodes,
-						Mod:   mod,
-						Raw:   raw,
-					},
+					s.Version: service,
 				},
 			},
 		},
 	}
 
-	ctx = withService(ctx, s)
 	diff, err := i.Merge(ctx, merge)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "Error merging merge changes")
@@ -106,18 +111,28 @@ func (i *Index) Remove(ctx context.Context, s *registry.Service) ([]*registry.Re
 }
 
 // Merge merges one index into another
-func (i *Index) Merge(ctx context.Context, merge *Index) ([]*registry.Result, error) {
+func (i *Index) Merge(ctx context.Context, merge *Index) ([]*Change, error) {
 	// Diff
-	diff := []*registry.Result{}
+	diff := []*Change{}
 
 	if i.Services == nil {
 		i.Services = make(map[string]*Services)
 	}
 
+	horizon := getHorizon(ctx)
+	recordHorizon := getRecordHorizon(ctx)
+
 	for name, services := range merge.Services {
 		for version, s1 := range services.Services {
 			s2 := i.GetService(name, version)
 
+			// If we dont have the service and it only holds tombstones
+			// older than the horizon then it was compacted, do not resurrect
+			// it
+			if s2 == nil && s1.compacted(horizon, recordHorizon) {
+				continue
+			}
+
 			// If we dont have the sevice, so create it
 			if s2 == nil {
 				v, ok := i.Services[name]
@@ -146,12 +161,7 @@ func (i *Index) ToMap() (map[string][]*registry.Service, error) {
 		slice := make([]*registry.Service, 0, len(services.Services))
 
 		for version, service := range services.Services {
-			var s *registry.Service
-
-			if err := msgpack.Unmarshal(service.Raw, &s); err != nil {
-				return nil, errors.Wrapf(err, "Error unmarshaling service `%s` version `%s`", name, version)
-			}
-
+			s := service.registryService(name, version)
 			if len(s.Nodes) == 0 {
 				continue
 			}
@@ -178,35 +188,67 @@ func (i *Index) GetService(name string, version string) *Service {
 	return v
 }
 
-// Clean index
-func (i *Index) Clean() ([]*registry.Result, error) {
-	ctx := context.TODO()
-	now := time.Now().UnixNano()
+// Clean disables nodes that have expired, the time is read from the clock
+// set with WithTime
+func (i *Index) Clean(ctx context.Context) ([]*Change, error) {
+	now := getTime(ctx).Now().UnixNano()
 
-	if i.Services == nil {
-		return nil, nil
-	}
+	return i.disable(ctx, func(node *Node) bool {
+		return node.Expiry != 0 && node.Expiry < now
+	})
+}
 
-	for _, services := range i.Services {
-		if services.Services == nil {
-			continue
-		}
+// DisableOwner disables all enabled nodes owned by a member
+func (i *Index) DisableOwner(ctx context.Context, owner string) ([]*Change, error) {
+	return i.disable(ctx, func(node *Node) bool {
+		return node.Owner == owner
+	})
+}
 
-		for _, service := range services.Services {
-			if service.Nodes == nil {
+// disable disables enabled nodes matching f. The node modification time is
+// bumped by one, so the change wins over the enabled node and every member
+// disabling the same node ends up with the same result
+func (i *Index) disable(ctx context.Context, f func(*Node) bool) ([]*Change, error) {
+	merge := NewIndex()
+
+	for name, services := range i.Services {
+		for version, service := range services.Services {
+			nodes := make(map[string]*Node)
+			for id, node := range service.Nodes {
+				if node.Enabled && f(node) {
+					nodes[id] = &Node{
+						Mod:    node.Mod + 1,
+						Expiry: node.Expiry,
+						Owner:  node.Owner,
+						Origin: node.Origin,
+					}
+				}
+			}
+
+			if len(nodes) == 0 {
 				continue
 			}
 
-			for _, node := range service.Nodes {
-				if node.Expiry != 0 && node.Expiry < now {
-					node.Enabled = false
-				}
+			v, ok := merge.Services[name]
+			if !ok {
+				v = &Services{Services: make(map[string]*Service)}
+				merge.Services[name] = v
+			}
+
+			v.Services[version] = &Service{
+				Mod:        service.Mod,
+				Nodes:      nodes,
+				Raw:        service.Raw,
+				Origin:     service.Origin,
+				Codec:      service.Codec,
+				Metadata:   service.Metadata,
+				Endpoints:  service.Endpoints,
+				Structured: true,
 			}
 		}
 	}
 
-	// Merge into self to trigger update
-	diff, err := i.Merge(ctx, i)
+	diff, err := i.Merge(ctx, merge)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error merging merge changes")
 	}
@@ -214,100 +256,366 @@ func (i *Index) Clean() ([]*registry.Result, error) {
 	return diff, nil
 }
 
-// Merge one service into another
-func (s *Service) Merge(ctx context.Context, name string, version string, merge *Service, diff *[]*registry.Result) error {
-	// Unmarshal service
-	s1, err := getService(nil, name, version, s.Raw)
-	if err != nil {
-		return errors.Wrap(err, "Could not get destination service")
+// Compact removes tombstones, disabled nodes last modified before the horizon
+// are replaced by a record of their modification time. Records older than the
+// record horizon are removed along with services and service lists left
+// empty. Merges must be given both horizons with WithHorizon and
+// WithRecordHorizon so peers that still have the nodes, live or removed, do
+// not bring them back. Returns the number of nodes removed
+func (i *Index) Compact(horizon int64, recordHorizon int64) int {
+	removed := 0
+
+	for name, services := range i.Services {
+		for version, service := range services.Services {
+			for id, node := range service.Nodes {
+				if node.compacted(horizon) {
+					if service.Compacted == nil {
+						service.Compacted = make(map[string]int64)
+					}
+					if node.Mod > service.Compacted[id] {
+						service.Compacted[id] = node.Mod
+					}
+
+					delete(service.Nodes, id)
+					removed++
+				}
+			}
+
+			for id, mod := range service.Compacted {
+				if mod < recordHorizon {
+					delete(service.Compacted, id)
+				}
+			}
+
+			if len(service.Nodes) == 0 && len(service.Compacted) == 0 && service.Mod < horizon {
+				delete(services.Services, version)
+			}
+		}
+
+		if len(services.Services) == 0 {
+			delete(i.Services, name)
+		}
 	}
 
-	s2, err := getService(ctx, name, version, merge.Raw)
-	if err != nil {
-		return errors.Wrap(err, "Could not get source service")
+	return removed
+}
+
+// Tombstones returns the number of disabled nodes
+func (i *Index) Tombstones() int {
+	count := 0
+	for _, services := range i.Services {
+		for _, service := range services.Services {
+			for _, node := range service.Nodes {
+				if !node.Enabled {
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
+
+// stamp is the time a node was last changed, expired nodes change when they
+// expire
+func (n *Node) stamp() int64 {
+	if n.Expiry > n.Mod {
+		return n.Expiry
+	}
+	return n.Mod
+}
+
+// compacted checks if Compact would have removed the service, live nodes are
+// never compacted however old they are
+func (s *Service) compacted(horizon int64, recordHorizon int64) bool {
+	if s.Mod >= horizon {
+		return false
+	}
+
+	for _, node := range s.Nodes {
+		if !node.compacted(horizon) {
+			return false
+		}
+	}
+
+	for _, mod := range s.Compacted {
+		if mod >= recordHorizon {
+			return false
+		}
+	}
+	return true
+}
+
+// compacted checks if the node is a tombstone Compact would have removed
+func (n *Node) compacted(horizon int64) bool {
+	return !n.Enabled && n.stamp() < horizon
+}
+
+// Merge one service into another. Service metadata and each node have their
+// own modification time, so concurrent changes to different nodes are all kept
+func (s *Service) Merge(ctx context.Context, name string, version string, merge *Service, diff *[]*Change) error {
+	// Members of older releases only send the encoded service, decode it once
+	var legacy *registry.Service
+	if !merge.Structured {
+		service, err := decodeService(merge.Codec, merge.Raw)
+		if err != nil {
+			return errors.Wrap(err, "Could not get source service")
+		}
+		legacy = service
 	}
 
 	// Has the service changed
 	changed := false
-	count := len(s1.Nodes)
+	previous := s.registryService(name, version)
+
+	clock := getClock(ctx)
+	clock.Observe(merge.Mod)
 
-	// If s2 is more recent than s1 then replace meta data
-	if s.Mod <= merge.Mod {
-		s1.Name = s2.Name
-		s1.Version = s2.Version
-		s1.Endpoints = s2.Endpoints
-		s1.Metadata = s2.Metadata
+	// If merge is more recent than s then replace meta data
+	if newer(s.Mod, s.Origin, merge.Mod, merge.Origin) {
+		s.Mod = merge.Mod
+		s.Origin = merge.Origin
+
+		if legacy != nil {
+			s.Metadata = legacy.Metadata
+			s.Endpoints = toEndpointRecords(legacy.Endpoints)
+		} else {
+			s.Metadata = merge.Metadata
+			s.Endpoints = merge.Endpoints
+		}
 
 		changed = true
 	}
 
+	horizon := getHorizon(ctx)
+	recordHorizon := getRecordHorizon(ctx)
+	added := make(map[string]bool)
+	removed := make(map[string]bool)
+	updated := make(map[string]bool)
+
+	// Nodes compacted by a peer are removed, copies that are not newer are
+	// from members that missed the removal
+	for id, mod := range merge.Compacted {
+		if mod < recordHorizon || mod <= s.Compacted[id] {
+			continue
+		}
+
+		if n1, ok := s.Nodes[id]; ok {
+			if n1.Mod > mod {
+				continue
+			}
+
+			if n1.Enabled {
+				removed[id] = true
+			}
+			delete(s.Nodes, id)
+		}
+
+		if s.Compacted == nil {
+			s.Compacted = make(map[string]int64)
+		}
+		s.Compacted[id] = mod
+		changed = true
+	}
+
 	// For each node in service
 	for id, n2 := range merge.Nodes {
+		clock.Observe(n2.Mod)
+
 		n1, ok := s.Nodes[id]
 		if !ok {
-			s.Nodes[id] = n2
-			n1 = n2
+			// Tombstones older than the horizon were compacted
+			if n2.compacted(horizon) {
+				continue
+			}
+
+			// The node was compacted after a change this copy did not see
+			if mod, ok := s.Compacted[id]; ok {
+				if n2.Mod <= mod {
+					continue
+				}
+				delete(s.Compacted, id)
+			}
+
+			n1 = &Node{}
+			s.Nodes[id] = n1
 		}
 
-		// If n2 is newer than n1 then replace meta data
-		if n1.Mod <= n2.Mod {
-			n1.Enabled = n2.Enabled
-			n1.Mod = n2.Mod
-			n1.Expiry = n2.Expiry
-			changed = true
+		// If n2 is not newer than n1 then keep n1
+		if ok && !newer(n1.Mod, n1.Origin, n2.Mod, n2.Origin) {
+			continue
+		}
 
-			i, node1 := NodeByID(s1.Nodes, id)
-			_, node2 := NodeByID(s2.Nodes, id)
+		enabled := n1.Enabled
+		address, port, metadata := n1.Address, n1.Port, n1.Metadata
+
+		n1.Enabled = n2.Enabled
+		n1.Mod = n2.Mod
+		n1.Expiry = n2.Expiry
+		n1.Owner = n2.Owner
+		n1.Origin = n2.Origin
+
+		// Disabled nodes are tombstones and do not keep their details
+		n1.Address, n1.Port, n1.Metadata = "", 0, nil
+		if n2.Enabled {
+			if legacy == nil {
+				n1.Address, n1.Port, n1.Metadata = n2.Address, n2.Port, n2.Metadata
+			} else if _, node := NodeByID(legacy.Nodes, id); node != nil {
+				n1.Address, n1.Port, n1.Metadata = node.Address, int64(node.Port), node.Metadata
+			}
+		}
 
-			// If non existent then insert
-			if i == -1 && n2.Enabled {
-				s1.Nodes = append(s1.Nodes, node2)
-				continue
-			} else if i != -1 {
-				// If enabled replace node meta data, else delete
-				if n2.Enabled {
-					node1.Address = node2.Address
-					node1.Metadata = node2.Metadata
-					node1.Port = node2.Port
-				} else {
-					s1.Nodes = append(s1.Nodes[:i], s1.Nodes[i+1:]...)
-				}
+		changed = true
+
+		switch {
+		case n2.Enabled && !enabled:
+			added[id] = true
+		case n2.Enabled:
+			// Registering a node again only moves its expiry, which is not
+			// an update to the node
+			if n1.Address != address || n1.Port != port || !reflect.DeepEqual(n1.Metadata, metadata) {
+				updated[id] = true
 			}
+		case enabled:
+			removed[id] = true
 		}
 	}
 
-	if changed {
-		if len(s1.Nodes) == 0 && count != 0 {
-			*diff = append(*diff, &registry.Result{
+	current := s.registryService(name, version)
+
+	// Changes that only move expiries or tombstones are not visible to
+	// watchers and are not published
+	if changed && !reflect.DeepEqual(previous, current) {
+		count := len(previous.Nodes)
+
+		change := &Change{
+			Added:   filterNodes(current.Nodes, added),
+			Removed: filterNodes(previous.Nodes, removed),
+			Updated: filterNodes(current.Nodes, updated),
+		}
+
+		if count != 0 {
+			change.Previous = previous
+		}
+
+		if len(current.Nodes) == 0 && count != 0 {
+			// Deletes carry the removed nodes so watchers know what went away
+			current.Nodes = change.Removed
+
+			change.Result = &registry.Result{
 				Action:  "delete",
-				Service: s1,
-			})
+				Service: current,
+			}
 		} else if count == 0 {
-			*diff = append(*diff, &registry.Result{
+			change.Result = &registry.Result{
 				Action:  "create",
-				Service: s1,
-			})
+				Service: current,
+			}
 		} else {
-			*diff = append(*diff, &registry.Result{
+			change.Result = &registry.Result{
 				Action:  "update",
-				Service: s1,
-			})
+				Service: current,
+			}
 		}
+
+		*diff = append(*diff, change)
+	}
+
+	s.Structured = true
+
+	// The encoded service is only kept up to date for members of older
+	// releases
+	if !getLegacyPayload(ctx) {
+		s.Raw = nil
+		s.Codec = ""
+		return nil
 	}
 
-	// Marshal service and store
-	raw, err := msgpack.Marshal(s1)
+	codec := getCodec(ctx)
+	raw, err := codec.Marshal(s.registryService(name, version))
 	if err != nil {
 		return errors.Wrap(err, "Error marshaling merged service")
 	}
 
-	// Update state
 	s.Raw = raw
+	s.Codec = codec.ID()
 
-	// Return
 	return nil
 }
 
+// registryService builds the registry service from the enabled nodes, nodes
+// are sorted by id
+func (s *Service) registryService(name string, version string) *registry.Service {
+	ids := make([]string, 0, len(s.Nodes))
+	for id, node := range s.Nodes {
+		if node.Enabled {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	service := &registry.Service{
+		Name:      name,
+		Version:   version,
+		Metadata:  copyMetadata(s.Metadata),
+		Endpoints: fromEndpointRecords(s.Endpoints),
+		Nodes:     make([]*registry.Node, 0, len(ids)),
+	}
+
+	for _, id := range ids {
+		node := s.Nodes[id]
+		service.Nodes = append(service.Nodes, &registry.Node{
+			Id:       id,
+			Address:  node.Address,
+			Port:     int(node.Port),
+			Metadata: copyMetadata(node.Metadata),
+		})
+	}
+
+	return service
+}
+
+// copyMetadata copies metadata so callers cannot modify the index
+func copyMetadata(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func filterNodes(nodes []*registry.Node, ids map[string]bool) []*registry.Node {
+	var filtered []*registry.Node
+	for _, node := range nodes {
+		if ids[node.Id] {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
+
+// fillMetadata replaces nil metadata in a decoded index with empty maps, as
+// protobuf does not tell them apart and registry users expect the maps to be
+// set
+func (i *Index) fillMetadata() {
+	for _, services := range i.Services {
+		for _, service := range services.Services {
+			if service.Metadata == nil {
+				service.Metadata = make(map[string]string)
+			}
+
+			for _, node := range service.Nodes {
+				if node.Enabled && node.Metadata == nil {
+					node.Metadata = make(map[string]string)
+				}
+			}
+		}
+	}
+}
+
 // NodeByID is a helper to loop through nodes to find a specific one
 func NodeByID(nodes []*registry.Node, id string) (int, *registry.Node) {
 	for i, node := range nodes {
@@ -318,44 +626,152 @@ func NodeByID(nodes []*registry.Node, id string) (int, *registry.Node) {
 	return -1, nil
 }
 
-type contextServiceID struct {
-	Name    string
-	Version string
+type contextCodec struct{}
+
+// WithCodec sets the codec used to encode services, services are decoded with
+// the codec they were encoded with
+func WithCodec(ctx context.Context, codec Codec) context.Context {
+	if ctx == nil {
+		ctx = context.TODO()
+	}
+
+	return context.WithValue(ctx, contextCodec{}, codec)
+}
+
+func getCodec(ctx context.Context) Codec {
+	if ctx != nil {
+		if codec, ok := ctx.Value(contextCodec{}).(Codec); ok {
+			return codec
+		}
+	}
+	return DefaultCodec
 }
 
-func withService(ctx context.Context, service *registry.Service) context.Context {
+type contextLegacyPayload struct{}
+
+// WithLegacyPayload sets whether services are also encoded into Service.Raw
+// with the codec, members of older releases only read that. DefaultLegacyPayload
+// is used if it is not set
+func WithLegacyPayload(ctx context.Context, enabled bool) context.Context {
 	if ctx == nil {
 		ctx = context.TODO()
 	}
 
-	id := contextServiceID{
-		Name:    service.Name,
-		Version: service.Version,
+	return context.WithValue(ctx, contextLegacyPayload{}, enabled)
+}
+
+func getLegacyPayload(ctx context.Context) bool {
+	if ctx != nil {
+		if enabled, ok := ctx.Value(contextLegacyPayload{}).(bool); ok {
+			return enabled
+		}
 	}
+	return DefaultLegacyPayload
+}
+
+type contextHorizon struct{}
+
+// WithHorizon sets the compaction horizon used by Merge, tombstones unknown to
+// the index that are older than the horizon are ignored. Live nodes are merged
+// unless the index holds a record of them being compacted, so members that
+// join late still learn long lived services
+func WithHorizon(ctx context.Context, horizon int64) context.Context {
+	if ctx == nil {
+		ctx = context.TODO()
+	}
+
+	return context.WithValue(ctx, contextHorizon{}, horizon)
+}
+
+func getHorizon(ctx context.Context) int64 {
+	if ctx != nil {
+		if horizon, ok := ctx.Value(contextHorizon{}).(int64); ok {
+			return horizon
+		}
+	}
+	return 0
+}
+
+type contextRecordHorizon struct{}
+
+// WithRecordHorizon sets the horizon up to which Compact has removed the
+// records of compacted nodes, records older than it are ignored by Merge
+func WithRecordHorizon(ctx context.Context, horizon int64) context.Context {
+	if ctx == nil {
+		ctx = context.TODO()
+	}
+
+	return context.WithValue(ctx, contextRecordHorizon{}, horizon)
+}
 
-	return context.WithValue(ctx, id, service)
+func getRecordHorizon(ctx context.Context) int64 {
+	if ctx != nil {
+		if horizon, ok := ctx.Value(contextRecordHorizon{}).(int64); ok {
+			return horizon
+		}
+	}
+	return 0
 }
 
-func getService(ctx context.Context, name string, version string, raw []byte) (*registry.Service, error) {
-	service := &registry.Service{}
-	id := contextServiceID{
-		Name:    name,
-		Version: version,
+// defaultClock is used when no clock is passed with WithClock
+var defaultClock = &HybridClock{}
+
+type contextClock struct{}
+
+// WithClock sets the clock used to timestamp and observe changes
+func WithClock(ctx context.Context, clock *HybridClock) context.Context {
+	if ctx == nil {
+		ctx = context.TODO()
 	}
 
+	return context.WithValue(ctx, contextClock{}, clock)
+}
+
+func getClock(ctx context.Context) *HybridClock {
 	if ctx != nil {
-		if service, ok := ctx.Value(id).(*registry.Service); ok {
-			return service, nil
+		if clock, ok := ctx.Value(contextClock{}).(*HybridClock); ok {
+			return clock
 		}
 	}
+	return defaultClock
+}
+
+type contextTime struct{}
 
-	if len(raw) == 0 {
-		return &registry.Service{}, nil
+// WithTime sets the clock expiry times are read from, the system clock is used
+// if none is set
+func WithTime(ctx context.Context, c clock.Clock) context.Context {
+	if ctx == nil {
+		ctx = context.TODO()
 	}
 
-	if err := msgpack.Unmarshal(raw, service); err != nil {
-		return nil, errors.Wrap(err, "Error unmarshaling service")
+	return context.WithValue(ctx, contextTime{}, c)
+}
+
+func getTime(ctx context.Context) clock.Clock {
+	if ctx != nil {
+		if c, ok := ctx.Value(contextTime{}).(clock.Clock); ok {
+			return c
+		}
+	}
+	return clock.System
+}
+
+type contextOwner struct{}
+
+func withOwner(ctx context.Context, owner string) context.Context {
+	if ctx == nil {
+		ctx = context.TODO()
 	}
 
-	return service, nil
+	return context.WithValue(ctx, contextOwner{}, owner)
+}
+
+func getOwner(ctx context.Context) string {
+	if ctx != nil {
+		if owner, ok := ctx.Value(contextOwner{}).(string); ok {
+			return owner
+		}
+	}
+	return ""
 }
@@ -1,11 +1,16 @@
 package state
 
 import (
+	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
+	"github.com/ThatsMrTalbot/cluster/clock"
 	"github.com/micro/go-micro/registry"
+	"github.com/micro/protobuf/proto"
 	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/context"
 )
 
 func TestMerge(t *testing.T) {
@@ -31,7 +36,7 @@ func TestMerge(t *testing.T) {
 
 			Convey("Then the diff should contain a created event", func() {
 				So(diff, ShouldHaveLength, 1)
-				So(diff[0], ShouldResemble, &registry.Result{
+				So(diff[0].Result, ShouldResemble, &registry.Result{
 					Action:  "create",
 					Service: service,
 				})
@@ -67,12 +72,16 @@ func TestMerge(t *testing.T) {
 
 			Convey("Then the diff should contain a removed event", func() {
 				So(diff, ShouldHaveLength, 1)
-				So(diff[0], ShouldResemble, &registry.Result{
+				So(diff[0].Result, ShouldResemble, &registry.Result{
 					Action:  "delete",
 					Service: service,
 				})
 			})
 
+			Convey("Then the removed service should not be modified", func() {
+				So(service.Nodes, ShouldHaveLength, 1)
+			})
+
 			Convey("Then the service should not exist", func() {
 				m, err := i.ToMap()
 				So(err, ShouldBeNil)
@@ -104,7 +113,7 @@ func TestMerge(t *testing.T) {
 
 			Convey("Then the diff should contain an update event", func() {
 				So(diff, ShouldHaveLength, 1)
-				So(diff[0], ShouldResemble, &registry.Result{
+				So(diff[0].Result, ShouldResemble, &registry.Result{
 					Action:  "update",
 					Service: service,
 				})
@@ -135,13 +144,11 @@ func TestMerge(t *testing.T) {
 			_, _, err := i.Add(nil, service, -time.Second)
 			So(err, ShouldBeNil)
 
-			diff, err := i.Clean()
-
-			Convey("Then the diff should contain an update event", func() {
-				service.Nodes = []*registry.Node{}
+			diff, err := i.Clean(nil)
 
+			Convey("Then the diff should contain a delete event with the expired node", func() {
 				So(diff, ShouldHaveLength, 1)
-				So(diff[0], ShouldResemble, &registry.Result{
+				So(diff[0].Result, ShouldResemble, &registry.Result{
 					Action:  "delete",
 					Service: service,
 				})
@@ -153,5 +160,555 @@ func TestMerge(t *testing.T) {
 				So(m, ShouldNotContainKey, "test")
 			})
 		})
+
+		Convey("When the nodes of an owner are disabled", func() {
+			service1 := &registry.Service{
+				Name: "test",
+				Nodes: []*registry.Node{
+					{
+						Id:      "node1",
+						Address: "127.0.0.1",
+						Port:    123,
+					},
+				},
+			}
+
+			service2 := &registry.Service{
+				Name: "test",
+				Nodes: []*registry.Node{
+					{
+						Id:      "node2",
+						Address: "127.0.0.1",
+						Port:    456,
+					},
+				},
+			}
+
+			_, _, err := i.Add(withOwner(nil, "member1"), service1, 0)
+			So(err, ShouldBeNil)
+
+			_, _, err = i.Add(withOwner(nil, "member2"), service2, 0)
+			So(err, ShouldBeNil)
+
+			diff, err := i.DisableOwner(nil, "member1")
+			So(err, ShouldBeNil)
+
+			Convey("Then the diff should contain an update event", func() {
+				So(diff, ShouldHaveLength, 1)
+				So(diff[0].Action, ShouldEqual, "update")
+			})
+
+			Convey("Then only the nodes of the owner should be removed", func() {
+				m, err := i.ToMap()
+				So(err, ShouldBeNil)
+				So(m["test"], ShouldHaveLength, 1)
+				So(m["test"][0].Nodes, ShouldHaveLength, 1)
+				So(m["test"][0].Nodes[0].Id, ShouldEqual, "node2")
+			})
+
+			Convey("Then disabling again should not produce a diff", func() {
+				diff, err := i.DisableOwner(nil, "member1")
+				So(err, ShouldBeNil)
+				So(diff, ShouldHaveLength, 0)
+			})
+		})
+
+		Convey("When tombstones are compacted", func() {
+			service := &registry.Service{
+				Name: "test",
+				Nodes: []*registry.Node{
+					{
+						Id:      "node1",
+						Address: "127.0.0.1",
+						Port:    123,
+					},
+				},
+			}
+
+			_, change, err := i.Add(nil, service, 0)
+			So(err, ShouldBeNil)
+
+			// Copy the change so it is not modified by later merges, this
+			// is the view of a peer that missed the removal
+			stale := copyIndex(change)
+
+			_, _, err = i.Remove(nil, service)
+			So(err, ShouldBeNil)
+
+			horizon := time.Now().UnixNano()
+			removed := i.Compact(horizon, 0)
+
+			Convey("Then the tombstones should be replaced by records", func() {
+				So(removed, ShouldEqual, 1)
+				So(i.GetService("test", "").Nodes, ShouldBeEmpty)
+				So(i.GetService("test", "").Compacted, ShouldContainKey, "node1")
+
+				m, err := i.ToMap()
+				So(err, ShouldBeNil)
+				So(m, ShouldNotContainKey, "test")
+			})
+
+			Convey("Then a stale peer rejoining should not resurrect the node", func() {
+				diff, err := i.Merge(WithHorizon(nil, horizon), copyIndex(stale))
+				So(err, ShouldBeNil)
+				So(diff, ShouldBeEmpty)
+
+				m, err := i.ToMap()
+				So(err, ShouldBeNil)
+				So(m, ShouldNotContainKey, "test")
+			})
+
+			Convey("Then the stale peer should remove its copy", func() {
+				peer := copyIndex(stale)
+
+				diff, err := peer.Merge(WithHorizon(nil, horizon), copyIndex(i))
+				So(err, ShouldBeNil)
+				So(diff, ShouldHaveLength, 1)
+				So(diff[0].Action, ShouldEqual, "delete")
+
+				m, err := peer.ToMap()
+				So(err, ShouldBeNil)
+				So(m, ShouldNotContainKey, "test")
+			})
+
+			Convey("Then a member that learnt the record should not take the stale copy", func() {
+				fresh := NewIndex()
+
+				_, err := fresh.Merge(WithHorizon(nil, horizon), copyIndex(i))
+				So(err, ShouldBeNil)
+
+				diff, err := fresh.Merge(WithHorizon(nil, horizon), copyIndex(stale))
+				So(err, ShouldBeNil)
+				So(diff, ShouldBeEmpty)
+			})
+
+			Convey("Then records older than the record horizon should be removed", func() {
+				i.Compact(horizon, time.Now().UnixNano())
+				So(i.Services, ShouldBeEmpty)
+			})
+
+			Convey("Then an old live service should reach a fresh member", func() {
+				fresh := NewIndex()
+
+				diff, err := fresh.Merge(WithHorizon(nil, horizon), copyIndex(stale))
+				So(err, ShouldBeNil)
+				So(diff, ShouldHaveLength, 1)
+				So(diff[0].Action, ShouldEqual, "create")
+
+				m, err := fresh.ToMap()
+				So(err, ShouldBeNil)
+				So(m, ShouldContainKey, "test")
+			})
+
+			Convey("Then a peer that still has the tombstone should not add it back", func() {
+				tombstone := copyIndex(stale)
+				for _, node := range tombstone.Services["test"].Services[""].Nodes {
+					node.Enabled = false
+					node.Mod++
+				}
+
+				diff, err := i.Merge(WithHorizon(nil, horizon), tombstone)
+				So(err, ShouldBeNil)
+				So(diff, ShouldBeEmpty)
+				So(i.GetService("test", "").Nodes, ShouldBeEmpty)
+			})
+
+			Convey("Then nodes registered after the horizon should be merged", func() {
+				other := NewIndex()
+				_, change, err := other.Add(nil, service, 0)
+				So(err, ShouldBeNil)
+
+				diff, err := i.Merge(WithHorizon(nil, horizon), change)
+				So(err, ShouldBeNil)
+				So(diff, ShouldHaveLength, 1)
+				So(diff[0].Action, ShouldEqual, "create")
+				So(i.GetService("test", "").Compacted, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When tombstones newer than the horizon are compacted", func() {
+			service := &registry.Service{
+				Name: "test",
+				Nodes: []*registry.Node{
+					{
+						Id:      "node1",
+						Address: "127.0.0.1",
+						Port:    123,
+					},
+				},
+			}
+
+			horizon := time.Now().UnixNano()
+
+			_, _, err := i.Add(nil, service, 0)
+			So(err, ShouldBeNil)
+
+			_, _, err = i.Remove(nil, service)
+			So(err, ShouldBeNil)
+
+			removed := i.Compact(horizon, 0)
+
+			Convey("Then the tombstones should be kept", func() {
+				So(removed, ShouldEqual, 0)
+				So(i.GetService("test", ""), ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestMergeChanges(t *testing.T) {
+	Convey("Given a service with two nodes", t, func() {
+		i := NewIndex()
+
+		node1 := &registry.Node{Id: "node1", Address: "127.0.0.1", Port: 123}
+		node2 := &registry.Node{Id: "node2", Address: "127.0.0.1", Port: 456}
+
+		service := &registry.Service{
+			Name:     "test",
+			Metadata: map[string]string{"a": "b"},
+			Nodes:    []*registry.Node{node1, node2},
+		}
+
+		_, _, err := i.Add(nil, copyService(service), 0)
+		So(err, ShouldBeNil)
+
+		Convey("When one node is removed", func() {
+			diff, _, err := i.Remove(nil, &registry.Service{
+				Name:     "test",
+				Metadata: map[string]string{"a": "b"},
+				Nodes:    []*registry.Node{node2},
+			})
+			So(err, ShouldBeNil)
+
+			Convey("Then the change should hold the removed node", func() {
+				So(diff, ShouldHaveLength, 1)
+				So(diff[0].Action, ShouldEqual, "update")
+				So(diff[0].Removed, ShouldResemble, []*registry.Node{node2})
+				So(diff[0].Added, ShouldBeEmpty)
+				So(diff[0].Service.Nodes, ShouldResemble, []*registry.Node{node1})
+				So(diff[0].Previous.Nodes, ShouldHaveLength, 2)
+			})
+		})
+
+		Convey("When all nodes are removed", func() {
+			diff, _, err := i.Remove(nil, copyService(service))
+			So(err, ShouldBeNil)
+
+			Convey("Then the delete should hold the removed nodes", func() {
+				So(diff, ShouldHaveLength, 1)
+				So(diff[0].Action, ShouldEqual, "delete")
+				So(diff[0].Service.Nodes, ShouldHaveLength, 2)
+				So(diff[0].Removed, ShouldHaveLength, 2)
+			})
+		})
+
+		Convey("When two members change different nodes concurrently", func() {
+			_, change1, err := NewIndex().Add(withOwner(nil, "member1"), &registry.Service{
+				Name:     "test",
+				Metadata: map[string]string{"a": "b"},
+				Nodes:    []*registry.Node{{Id: "node1", Address: "10.0.0.1", Port: 123}},
+			}, 0)
+			So(err, ShouldBeNil)
+
+			_, change2, err := NewIndex().Add(withOwner(nil, "member2"), &registry.Service{
+				Name:     "test",
+				Metadata: map[string]string{"a": "b"},
+				Nodes:    []*registry.Node{{Id: "node2", Address: "10.0.0.2", Port: 456}},
+			}, 0)
+			So(err, ShouldBeNil)
+
+			i1 := copyIndex(i)
+			_, err = i1.Merge(nil, copyIndex(change1))
+			So(err, ShouldBeNil)
+			_, err = i1.Merge(nil, copyIndex(change2))
+			So(err, ShouldBeNil)
+
+			i2 := copyIndex(i)
+			_, err = i2.Merge(nil, copyIndex(change2))
+			So(err, ShouldBeNil)
+			_, err = i2.Merge(nil, copyIndex(change1))
+			So(err, ShouldBeNil)
+
+			Convey("Then both changes should be kept in any order", func() {
+				for _, index := range []*Index{i1, i2} {
+					m, err := index.ToMap()
+					So(err, ShouldBeNil)
+					So(m["test"], ShouldHaveLength, 1)
+					So(m["test"][0].Nodes, ShouldHaveLength, 2)
+					So(m["test"][0].Nodes[0].Address, ShouldEqual, "10.0.0.1")
+					So(m["test"][0].Nodes[1].Address, ShouldEqual, "10.0.0.2")
+				}
+			})
+		})
+
+		Convey("When a node is added, a node moves and the metadata changes", func() {
+			moved := &registry.Node{Id: "node1", Address: "10.0.0.1", Port: 123}
+			node3 := &registry.Node{Id: "node3", Address: "127.0.0.1", Port: 789}
+
+			diff, _, err := i.Add(nil, &registry.Service{
+				Name:     "test",
+				Metadata: map[string]string{"a": "c"},
+				Nodes:    []*registry.Node{moved, node2, node3},
+			}, 0)
+			So(err, ShouldBeNil)
+
+			Convey("Then the change should hold the added and updated nodes", func() {
+				So(diff, ShouldHaveLength, 1)
+				So(diff[0].Action, ShouldEqual, "update")
+				So(diff[0].Added, ShouldResemble, []*registry.Node{node3})
+				So(diff[0].Updated, ShouldResemble, []*registry.Node{moved})
+			})
+
+			Convey("Then the change should hold the previous and current metadata", func() {
+				So(diff[0].Previous.Metadata, ShouldResemble, map[string]string{"a": "b"})
+				So(diff[0].Service.Metadata, ShouldResemble, map[string]string{"a": "c"})
+			})
+		})
+
+		Convey("When the service is registered again with a new expiry", func() {
+			diff, _, err := i.Add(nil, copyService(service), time.Minute)
+			So(err, ShouldBeNil)
+
+			Convey("Then no change should be published", func() {
+				So(diff, ShouldBeEmpty)
+			})
+
+			Convey("Then the expiry should be updated", func() {
+				So(i.GetService("test", "").Nodes["node1"].Expiry, ShouldNotEqual, 0)
+			})
+		})
+	})
+}
+
+func TestMergeOrdering(t *testing.T) {
+	Convey("Given a service registered by a member with a fast clock", t, func() {
+		service := &registry.Service{
+			Name: "test",
+			Nodes: []*registry.Node{
+				{
+					Id:      "node1",
+					Address: "127.0.0.1",
+					Port:    123,
+				},
+			},
+		}
+
+		now := time.Unix(1000, 0)
+		fast := &HybridClock{Wall: clock.NewFake(now.Add(time.Second * 30))}
+
+		_, change, err := NewIndex().Add(WithClock(nil, fast), copyService(service), 0)
+		So(err, ShouldBeNil)
+
+		Convey("When a member with a slow clock removes it", func() {
+			slow := &HybridClock{Wall: clock.NewFake(now)}
+			i := NewIndex()
+
+			_, err := i.Merge(WithClock(nil, slow), change)
+			So(err, ShouldBeNil)
+
+			_, removal, err := i.Remove(WithClock(nil, slow), copyService(service))
+			So(err, ShouldBeNil)
+
+			Convey("Then the service should be removed", func() {
+				m, err := i.ToMap()
+				So(err, ShouldBeNil)
+				So(m, ShouldNotContainKey, "test")
+			})
+
+			Convey("Then the removal should win on other members", func() {
+				other := NewIndex()
+
+				_, err := other.Merge(nil, removal)
+				So(err, ShouldBeNil)
+
+				_, err = other.Merge(nil, change)
+				So(err, ShouldBeNil)
+
+				m, err := other.ToMap()
+				So(err, ShouldBeNil)
+				So(m, ShouldNotContainKey, "test")
+			})
+		})
+
+		Convey("When a member with a slow clock disables the owner", func() {
+			slow := &HybridClock{Wall: clock.NewFake(now)}
+			i := NewIndex()
+
+			_, err := i.Merge(nil, change)
+			So(err, ShouldBeNil)
+
+			diff, err := i.DisableOwner(WithClock(nil, slow), "")
+			So(err, ShouldBeNil)
+			So(diff, ShouldHaveLength, 1)
+
+			Convey("Then its clock should move past the disabled nodes", func() {
+				So(slow.Now(), ShouldBeGreaterThan, now.Add(time.Second*30).UnixNano()+1)
+			})
+		})
+	})
+
+	Convey("Given two changes with the same timestamp", t, func() {
+		ctx := WithClock(nil, &HybridClock{})
+
+		service := &registry.Service{
+			Name: "test",
+			Nodes: []*registry.Node{
+				{
+					Id:      "node1",
+					Address: "127.0.0.1",
+					Port:    123,
+				},
+			},
+		}
+
+		_, added, err := NewIndex().Add(withOwner(ctx, "member1"), copyService(service), 0)
+		So(err, ShouldBeNil)
+
+		_, removed, err := NewIndex().Remove(withOwner(ctx, "member2"), copyService(service))
+		So(err, ShouldBeNil)
+
+		// Force the same timestamp on both changes
+		mod := added.Services["test"].Services[""].Mod
+		removed.Services["test"].Services[""].Mod = mod
+		removed.Services["test"].Services[""].Nodes["node1"].Mod = mod
+
+		Convey("When they are merged in different orders", func() {
+			i1 := NewIndex()
+			_, err := i1.Merge(nil, copyIndex(added))
+			So(err, ShouldBeNil)
+			_, err = i1.Merge(nil, copyIndex(removed))
+			So(err, ShouldBeNil)
+
+			i2 := NewIndex()
+			_, err = i2.Merge(nil, copyIndex(removed))
+			So(err, ShouldBeNil)
+			_, err = i2.Merge(nil, copyIndex(added))
+			So(err, ShouldBeNil)
+
+			Convey("Then both should pick the change with the greater origin", func() {
+				So(i1.GetService("test", "").Nodes["node1"].Origin, ShouldEqual, "member2")
+				So(i2.GetService("test", "").Nodes["node1"].Origin, ShouldEqual, "member2")
+
+				m1, err := i1.ToMap()
+				So(err, ShouldBeNil)
+				m2, err := i2.ToMap()
+				So(err, ShouldBeNil)
+
+				So(m1, ShouldNotContainKey, "test")
+				So(m2, ShouldNotContainKey, "test")
+			})
+		})
+	})
+}
+
+func TestMergeConvergence(t *testing.T) {
+	Convey("Given changes made by members with skewed clocks", t, func() {
+		r := rand.New(rand.NewSource(1))
+		base := time.Unix(1000, 0)
+
+		Convey("When they are merged in random orders", func() {
+			Convey("Then every index should converge", func() {
+				for trial := 0; trial < 50; trial++ {
+					changes := randomChanges(r, base, 3, 30)
+
+					var digest *Digest
+					for n := 0; n < 4; n++ {
+						i := NewIndex()
+						for _, p := range r.Perm(len(changes)) {
+							_, err := i.Merge(nil, copyIndex(changes[p]))
+							So(err, ShouldBeNil)
+						}
+
+						if digest == nil {
+							digest = i.Digest()
+						}
+						So(i.Digest(), ShouldResemble, digest)
+					}
+				}
+			})
+		})
 	})
 }
+
+// randomChanges makes n random registrations and removals across the members.
+// Each member has a fake clock that is set to a random time around base before
+// every change, so timestamps arrive in any order and may go backwards
+func randomChanges(r *rand.Rand, base time.Time, members int, n int) []*Index {
+	type member struct {
+		ctx   context.Context
+		wall  *clock.Fake
+		index *Index
+	}
+
+	m := make([]member, members)
+	for i := range m {
+		wall := clock.NewFake(base)
+		ctx := WithClock(nil, &HybridClock{Wall: wall})
+		m[i] = member{
+			ctx:   withOwner(ctx, fmt.Sprintf("member%d", i)),
+			wall:  wall,
+			index: NewIndex(),
+		}
+	}
+
+	changes := make([]*Index, 0, n)
+	for c := 0; c < n; c++ {
+		mem := m[r.Intn(members)]
+		mem.wall.Set(base.Add(time.Duration(r.Int63n(int64(time.Minute)))))
+
+		service := &registry.Service{
+			Name:    fmt.Sprintf("service%d", r.Intn(2)),
+			Version: fmt.Sprintf("%d", r.Intn(2)),
+			Metadata: map[string]string{
+				"change": fmt.Sprintf("%d", c),
+				"member": fmt.Sprintf("%d", r.Intn(members)),
+				"region": "eu-west-1",
+				"zone":   "eu-west-1a",
+			},
+			Nodes: []*registry.Node{
+				{
+					Id:      fmt.Sprintf("node%d", r.Intn(3)),
+					Address: "127.0.0.1",
+					Port:    c,
+					Metadata: map[string]string{
+						"change": fmt.Sprintf("%d", c),
+						"weight": fmt.Sprintf("%d", r.Intn(10)),
+						"zone":   "eu-west-1a",
+					},
+				},
+			},
+		}
+
+		var change *Index
+		var err error
+		if r.Intn(3) == 0 {
+			_, change, err = mem.index.Remove(mem.ctx, service)
+		} else {
+			_, change, err = mem.index.Add(mem.ctx, service, 0)
+		}
+		So(err, ShouldBeNil)
+
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+func copyService(s *registry.Service) *registry.Service {
+	c := *s
+	c.Nodes = make([]*registry.Node, len(s.Nodes))
+	for i, node := range s.Nodes {
+		n := *node
+		c.Nodes[i] = &n
+	}
+	return &c
+}
+
+func copyIndex(i *Index) *Index {
+	byt, err := proto.Marshal(i)
+	So(err, ShouldBeNil)
+
+	c := &Index{}
+	So(proto.Unmarshal(byt, c), ShouldBeNil)
+	return c
+}
@@ -0,0 +1,156 @@
+package state
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/metrics"
+	"github.com/micro/go-micro/registry"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// recorder records metrics in memory
+type recorder struct {
+	mu     sync.Mutex
+	values map[string]float64
+	counts map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		values: make(map[string]float64),
+		counts: make(map[string]int),
+	}
+}
+
+func (r *recorder) Add(name string, delta float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.values[name] += delta
+	r.counts[name]++
+}
+
+func (r *recorder) Set(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.values[name] = value
+	r.counts[name]++
+}
+
+func (r *recorder) Observe(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.values[name] = value
+	r.counts[name]++
+}
+
+func (r *recorder) Value(name string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.values[name]
+}
+
+func (r *recorder) Count(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.counts[name]
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("Given a state recording metrics", t, func() {
+		m := newRecorder()
+
+		WithState(func(s *State) {
+			Convey("When services are registered", func() {
+				s1, s2 := newService("s1"), newService("s2")
+				s2.Nodes = append(s2.Nodes, newService("s2").Nodes...)
+
+				So(s.Register(s1), ShouldBeNil)
+				So(s.Register(s2), ShouldBeNil)
+
+				Convey("Then the registers and services should be recorded", func() {
+					So(m.Value(metrics.Registers), ShouldEqual, 2)
+					So(m.Value(metrics.Services), ShouldEqual, 2)
+					So(m.Value(metrics.Nodes), ShouldEqual, 3)
+				})
+
+				Convey("And a service is registered again to refresh its expiry", func() {
+					So(s.Register(s1, registry.RegisterTTL(time.Minute)), ShouldBeNil)
+
+					Convey("Then the register should not be counted", func() {
+						So(m.Value(metrics.Registers), ShouldEqual, 2)
+					})
+				})
+
+				Convey("And a node is deregistered and the state cleaned", func() {
+					removed := *s2
+					removed.Nodes = s2.Nodes[:1]
+
+					So(s.Deregister(&removed), ShouldBeNil)
+					So(s.Clean(), ShouldBeNil)
+
+					Convey("Then the deregister, clean and tombstone should be recorded", func() {
+						So(m.Value(metrics.Deregisters), ShouldEqual, 1)
+						So(m.Value(metrics.Services), ShouldEqual, 2)
+						So(m.Value(metrics.Nodes), ShouldEqual, 2)
+						So(m.Value(metrics.Cleans), ShouldEqual, 1)
+						So(m.Value(metrics.Tombstones), ShouldEqual, 1)
+					})
+
+					Convey("And the node is deregistered again", func() {
+						So(s.Deregister(&removed), ShouldBeNil)
+
+						Convey("Then the deregister should not be counted", func() {
+							So(m.Value(metrics.Deregisters), ShouldEqual, 1)
+						})
+					})
+
+					Convey("And an unknown service is deregistered", func() {
+						So(s.Deregister(newService("unknown")), ShouldBeNil)
+
+						Convey("Then the deregister should not be counted", func() {
+							So(m.Value(metrics.Deregisters), ShouldEqual, 1)
+						})
+					})
+				})
+			})
+
+			Convey("When a remote state is merged", WithState(func(remote *State) {
+				So(remote.Register(newService("remote")), ShouldBeNil)
+
+				byt, err := remote.LocalState()
+				So(err, ShouldBeNil)
+				So(s.MergeRemote(byt), ShouldBeNil)
+
+				Convey("Then the merge should be recorded", func() {
+					So(m.Count(metrics.MergeDuration), ShouldEqual, 1)
+					So(m.Value(metrics.MergeDiffSize), ShouldEqual, 1)
+					So(m.Value(metrics.MergeErrors), ShouldEqual, 0)
+				})
+			}))
+
+			Convey("When an invalid remote state is merged", func() {
+				So(s.MergeRemote([]byte{0xff}), ShouldNotBeNil)
+
+				Convey("Then the error should be recorded", func() {
+					So(m.Value(metrics.MergeErrors), ShouldEqual, 1)
+				})
+			})
+
+			Convey("When a watcher falls behind", WithWatcher(s, func(w registry.Watcher) {
+				So(s.Register(newService("a")), ShouldBeNil)
+				So(s.Register(newService("b")), ShouldBeNil)
+
+				Convey("Then the dropped result should be recorded", func() {
+					So(m.Value(metrics.WatcherDrops), ShouldEqual, 1)
+				})
+			}))
+		}, Metrics(m), WatchQueueSize(1), WatchOverflow(DropOldest))()
+	})
+}
@@ -0,0 +1,139 @@
+package state
+
+import (
+	"time"
+
+	"github.com/ThatsMrTalbot/cluster/clock"
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/metrics"
+)
+
+var (
+	// DefaultWatchQueueSize is the default number of results queued per watcher
+	DefaultWatchQueueSize = 100
+
+	// DefaultWatchOverflow is the default policy used when a watchers queue is full
+	DefaultWatchOverflow = Disconnect
+
+	// DefaultHistorySize is the default number of published results kept for
+	// resuming watchers
+	DefaultHistorySize = 1000
+
+	// DefaultTombstoneRetention is the default time removed nodes are kept
+	DefaultTombstoneRetention = time.Hour
+
+	// DefaultLegacyPayload is whether services are encoded for members of
+	// older releases by default, so a cluster can be upgraded one member at
+	// a time
+	DefaultLegacyPayload = true
+)
+
+type options struct {
+	Owner          string
+	Codec          Codec
+	LegacyPayload  bool
+	WatchQueueSize int
+	WatchOverflow  OverflowPolicy
+	HistorySize    int
+	Metrics        metrics.Metrics
+	Clock          clock.Clock
+
+	TombstoneRetention time.Duration
+}
+
+func parse(opts ...Option) *options {
+	options := &options{
+		WatchQueueSize: DefaultWatchQueueSize,
+		WatchOverflow:  DefaultWatchOverflow,
+		HistorySize:    DefaultHistorySize,
+		Codec:          DefaultCodec,
+		LegacyPayload:  DefaultLegacyPayload,
+		Metrics:        metrics.Nop,
+		Clock:          clock.System,
+
+		TombstoneRetention: DefaultTombstoneRetention,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	return options
+}
+
+// Option is an option for the state
+type Option func(*options)
+
+// WatchQueueSize sets the number of results queued per watcher
+func WatchQueueSize(n int) Option {
+	return func(o *options) {
+		o.WatchQueueSize = n
+	}
+}
+
+// WatchOverflow sets the policy used when a watchers queue is full
+func WatchOverflow(p OverflowPolicy) Option {
+	return func(o *options) {
+		o.WatchOverflow = p
+	}
+}
+
+// HistorySize sets the number of published results kept so watchers can
+// resume with WatchSince, zero disables resuming
+func HistorySize(n int) Option {
+	return func(o *options) {
+		o.HistorySize = n
+	}
+}
+
+// PayloadCodec sets the codec used to encode services for LegacyPayload, the
+// codec is also registered for decoding. Members keep decoding services
+// encoded with other registered codecs, so the codec can be changed one member
+// at a time
+func PayloadCodec(c Codec) Option {
+	return func(o *options) {
+		RegisterCodec(c)
+		o.Codec = c
+	}
+}
+
+// LegacyPayload sets whether services are also encoded into Service.Raw, which
+// is all members of older releases read. It is enabled by default, disable it
+// once no such members remain in the cluster as it costs an encode on every
+// change
+func LegacyPayload(enabled bool) Option {
+	return func(o *options) {
+		o.LegacyPayload = enabled
+	}
+}
+
+// Metrics sets where state metrics are recorded
+func Metrics(m metrics.Metrics) Option {
+	return func(o *options) {
+		o.Metrics = m
+	}
+}
+
+// Clock sets the clock expiry and change timestamps are read from
+func Clock(c clock.Clock) Option {
+	return func(o *options) {
+		o.Clock = c
+	}
+}
+
+// Owner sets the name of the member that owns locally registered nodes
+func Owner(name string) Option {
+	return func(o *options) {
+		o.Owner = name
+	}
+}
+
+// TombstoneRetention sets how long removed nodes are kept before they are
+// compacted. Compacted nodes leave a record of their id and modification time
+// that is kept for another retention period, so members partitioned for up to
+// twice the retention cannot bring back nodes removed while they were away.
+// Zero disables compaction
+func TombstoneRetention(d time.Duration) Option {
+	return func(o *options) {
+		o.TombstoneRetention = d
+	}
+}
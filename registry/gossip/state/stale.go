@@ -0,0 +1,149 @@
+package state
+
+import "github.com/micro/go-micro/registry"
+
+// staleNode is a node loaded from a snapshot that no member has confirmed
+// since. Staleness is only known to this member, it is never gossiped
+type staleNode struct {
+	mod      int64
+	deadline int64
+}
+
+func staleKey(name string, version string, id string) string {
+	return name + "/" + version + "/" + id
+}
+
+// markStale marks the enabled nodes of a loaded index as stale until the
+// deadline, the state lock must be held
+func (state *State) markStale(index *Index, deadline int64) {
+	if state.stale == nil {
+		state.stale = make(map[string]staleNode)
+	}
+
+	for name, services := range index.Services {
+		for version, service := range services.Services {
+			for id, node := range service.Nodes {
+				if node.Enabled {
+					state.stale[staleKey(name, version, id)] = staleNode{
+						mod:      node.Mod,
+						deadline: deadline,
+					}
+				}
+			}
+		}
+	}
+}
+
+// observe clears the stale mark of nodes a peer sent a newer copy of. Copies
+// that are not newer prove nothing, after a whole cluster restarts from
+// snapshots every member still holds the restored nodes. The state lock must
+// be held
+func (state *State) observe(index *Index) {
+	if len(state.stale) == 0 {
+		return
+	}
+
+	for name, services := range index.Services {
+		for version, service := range services.Services {
+			for id, node := range service.Nodes {
+				key := staleKey(name, version, id)
+				if mark, ok := state.stale[key]; ok && node.Mod > mark.mod {
+					delete(state.stale, key)
+				}
+			}
+		}
+	}
+}
+
+// ConfirmOwner clears the stale mark of nodes loaded from a snapshot that are
+// owned by a member known to be alive
+func (state *State) ConfirmOwner(owner string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if len(state.stale) == 0 {
+		return
+	}
+
+	for name, services := range state.index.Services {
+		for version, service := range services.Services {
+			for id, node := range service.Nodes {
+				if node.Owner == owner {
+					delete(state.stale, staleKey(name, version, id))
+				}
+			}
+		}
+	}
+}
+
+// expireStale removes stale nodes past their deadline that have not changed
+// since they were loaded. They are removed from the local index without a
+// tombstone, so members that still hold them keep them and can send them
+// back. The state lock must be held
+func (state *State) expireStale(now int64) []*Change {
+	var diff []*Change
+
+	for name, services := range state.index.Services {
+		for version, service := range services.Services {
+			removed := make(map[string]bool)
+			for id, node := range service.Nodes {
+				key := staleKey(name, version, id)
+				mark, ok := state.stale[key]
+				if !ok {
+					continue
+				}
+
+				if node.Mod != mark.mod || !node.Enabled {
+					delete(state.stale, key)
+					continue
+				}
+
+				if mark.deadline <= now {
+					removed[id] = true
+					delete(state.stale, key)
+				}
+			}
+
+			if len(removed) == 0 {
+				continue
+			}
+
+			previous := service.registryService(name, version)
+			for id := range removed {
+				delete(service.Nodes, id)
+			}
+			current := service.registryService(name, version)
+
+			change := &Change{
+				Previous: previous,
+				Removed:  filterNodes(previous.Nodes, removed),
+			}
+
+			if len(current.Nodes) == 0 {
+				current.Nodes = change.Removed
+				change.Result = &registry.Result{Action: "delete", Service: current}
+			} else {
+				change.Result = &registry.Result{Action: "update", Service: current}
+			}
+
+			if len(service.Nodes) == 0 {
+				delete(services.Services, version)
+			}
+
+			diff = append(diff, change)
+		}
+
+		if len(services.Services) == 0 {
+			delete(state.index.Services, name)
+		}
+	}
+
+	// Marks of nodes that were removed some other way are no longer needed
+	for key, mark := range state.stale {
+		if mark.deadline <= now {
+			delete(state.stale, key)
+		}
+	}
+
+	return diff
+}
@@ -8,6 +8,7 @@ import (
 
 	"golang.org/x/net/context"
 
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/metrics"
 	"github.com/micro/go-micro/registry"
 	"github.com/micro/protobuf/proto"
 	"github.com/pborman/uuid"
@@ -20,64 +21,281 @@ import (
 
 // State is the state of the registry
 type State struct {
+	opts     *options
 	mu       sync.RWMutex
 	services map[string][]*registry.Service
 	index    *Index
-	subs     map[string]chan *registry.Result
+	subs     map[string]*Watch
+	clock    *HybridClock
+	stop     chan struct{}
+	stopped  bool
+
+	// horizon is the time up to which tombstones have been compacted
+	horizon int64
+
+	// recordHorizon is the time up to which the records of compacted nodes
+	// have been removed
+	recordHorizon int64
+
+	// stale holds the nodes loaded with Load that have not changed since
+	stale map[string]staleNode
+
+	// revision is the revision of the last published result
+	revision uint64
+	history  *history
+
+	// serviceCount and nodeCount count the services and nodes in the lookup
+	// map
+	serviceCount int
+	nodeCount    int
 }
 
-// NewState creates a new state
-func NewState(tick time.Duration) *State {
+// NewState creates a new state that cleans expired nodes every tick, a tick
+// of zero disables cleaning so Clean must be called
+func NewState(tick time.Duration, opts ...Option) *State {
+	options := parse(opts...)
+
 	s := &State{
+		opts:     options,
 		services: make(map[string][]*registry.Service),
 		index:    &Index{},
-		subs:     make(map[string]chan *registry.Result),
+		subs:     make(map[string]*Watch),
+		clock:    &HybridClock{Wall: options.Clock},
+		stop:     make(chan struct{}),
+		history:  newHistory(options.HistorySize),
+	}
+
+	if tick > 0 {
+		go s.doClean(tick)
 	}
-	go s.doClean(tick)
 	return s
 }
 
-// Watch creates a watcher
+// Watch creates a watcher for every change
 func (state *State) Watch() (registry.Watcher, error) {
-	kill := make(chan struct{})
-	result := make(chan *registry.Result, 10)
-	id := uuid.NewUUID().String()
+	return state.WatchWith()
+}
 
-	watch := &Watch{
-		result: result,
-		close:  kill,
+// WatchWith creates a watcher, results are filtered by the options before
+// they are queued
+func (state *State) WatchWith(opts ...WatchOption) (registry.Watcher, error) {
+	var options watchOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	filter, err := newFilter(options)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing watch options")
+	}
+
+	snapshot := options.snapshot
+	resume := options.since != nil
+	if snapshot && resume {
+		return nil, errors.New("WatchSnapshot and WatchSince cannot be combined")
 	}
 
+	id := uuid.NewUUID().String()
+
 	state.mu.Lock()
+	if state.stopped {
+		state.mu.Unlock()
+		return nil, errors.New("State has been stopped")
+	}
 	if state.subs == nil {
-		state.subs = make(map[string]chan *registry.Result)
+		state.subs = make(map[string]*Watch)
 	}
-	state.subs[id] = result
+	o := state.options()
+	watch := newWatch(id, o.WatchQueueSize, o.WatchOverflow)
+	watch.filter = filter
+
+	// The snapshot and replay are taken under the lock so no change can be
+	// published between them and the subscription
+	if snapshot {
+		watch.revision = state.revision
+		watch.preload(state.snapshot(filter))
+	}
+
+	if resume {
+		replay, ok := state.getHistory().since(*options.since, state.revision)
+		if !ok {
+			state.mu.Unlock()
+			return nil, ErrCompacted
+		}
+
+		watch.revision = *options.since
+		watch.preload(filterHistory(replay, filter))
+	}
+	state.subs[id] = watch
 	state.mu.Unlock()
 
 	go func() {
-		<-kill
+		<-watch.close
 
 		// unsub
 		state.mu.Lock()
 		delete(state.subs, id)
 		state.mu.Unlock()
-
-		// close
-		close(result)
 	}()
 
 	return watch, nil
 }
 
-func (state *State) pub(res []*registry.Result) {
+// snapshot returns a create result for every service matching the filter
+// followed by the synced marker, the state lock must be held
+func (state *State) snapshot(f *filter) []revision {
+	var res []revision
+	for _, services := range state.services {
+		for _, s := range services {
+			if f.match(s) {
+				res = append(res, revision{
+					revision: state.revision,
+					change: &Change{
+						Result: &registry.Result{
+							Action:  "create",
+							Service: s,
+						},
+						Added: s.Nodes,
+					},
+				})
+			}
+		}
+	}
+
+	return append(res, revision{
+		revision: state.revision,
+		change: &Change{
+			Result: &registry.Result{
+				Action:  ActionSynced,
+				Service: &registry.Service{},
+			},
+		},
+	})
+}
+
+// getHistory returns the published result history, the state lock must be
+// held
+func (state *State) getHistory() *history {
+	if state.history == nil {
+		state.history = newHistory(state.options().HistorySize)
+	}
+	return state.history
+}
+
+func filterHistory(res []revision, f *filter) []revision {
+	filtered := make([]revision, 0, len(res))
 	for _, r := range res {
-		for _, c := range state.subs {
-			c <- r
+		if c := f.change(r.change); c != nil {
+			filtered = append(filtered, revision{revision: r.revision, change: c})
+		}
+	}
+	return filtered
+}
+
+// options returns the state options, the state lock must be held
+func (state *State) options() *options {
+	if state.opts == nil {
+		state.opts = parse()
+	}
+	return state.opts
+}
+
+// context returns the context passed to index operations, the state lock
+// must be held
+func (state *State) context() context.Context {
+	if state.clock == nil {
+		state.clock = &HybridClock{Wall: state.options().Clock}
+	}
+
+	ctx := withOwner(nil, state.options().Owner)
+	ctx = WithClock(ctx, state.clock)
+	ctx = WithTime(ctx, state.options().Clock)
+	ctx = WithCodec(ctx, state.options().Codec)
+	ctx = WithLegacyPayload(ctx, state.options().LegacyPayload)
+	ctx = WithHorizon(ctx, state.horizon)
+	ctx = WithRecordHorizon(ctx, state.recordHorizon)
+	return ctx
+}
+
+// Watchers returns the delivery stats of all open watchers
+func (state *State) Watchers() []WatchStats {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	stats := make([]WatchStats, 0, len(state.subs))
+	for _, w := range state.subs {
+		stats = append(stats, w.Stats())
+	}
+	return stats
+}
+
+// pub assigns each result the next revision, records it in the history and
+// queues it on every watcher whose filter matches. It never blocks on slow
+// watchers
+func (state *State) pub(changes []*Change) {
+	history := state.getHistory()
+
+	for _, c := range changes {
+		state.revision++
+		history.add(state.revision, c)
+
+		for _, w := range state.subs {
+			fc := w.filter.change(c)
+			if fc == nil {
+				continue
+			}
+			if w.push(fc, state.revision) {
+				state.options().Metrics.Add(metrics.WatcherDrops, 1)
+			}
 		}
 	}
 }
 
+// apply updates the lookup map with the results of an index change rather
+// than rebuilding it, the state lock must be held. Slices are replaced rather
+// than modified as they may have been returned by GetService
+func (state *State) apply(changes []*Change) {
+	if state.services == nil {
+		state.services = make(map[string][]*registry.Service)
+	}
+
+	for _, r := range changes {
+		name := r.Service.Name
+		existing := state.services[name]
+
+		services := make([]*registry.Service, 0, len(existing)+1)
+		for _, s := range existing {
+			if s.Version != r.Service.Version {
+				services = append(services, s)
+			} else {
+				state.serviceCount--
+				state.nodeCount -= len(s.Nodes)
+			}
+		}
+
+		// The service of a delete holds the removed nodes
+		if r.Action != "delete" && len(r.Service.Nodes) != 0 {
+			s := *r.Service
+			s.Nodes = make([]*registry.Node, len(r.Service.Nodes))
+			copy(s.Nodes, r.Service.Nodes)
+			services = append(services, &s)
+
+			state.serviceCount++
+			state.nodeCount += len(s.Nodes)
+		}
+
+		if len(services) == 0 {
+			delete(state.services, name)
+		} else {
+			state.services[name] = services
+		}
+	}
+
+	m := state.options().Metrics
+	m.Set(metrics.Services, float64(state.serviceCount))
+	m.Set(metrics.Nodes, float64(state.nodeCount))
+}
+
 // String implements strings
 func (state *State) String() string {
 	return "state"
@@ -125,25 +343,25 @@ func (state *State) RegisterAndReturnChange(s *registry.Service, ops ...registry
 		o(&options)
 	}
 
-	diff, change, err := state.index.Add(nil, s, options.TTL)
+	diff, change, err := state.index.Add(state.context(), s, options.TTL)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error adding service to index")
 	}
 
+	// Registering again only to refresh the expiry is not counted
+	if len(diff) != 0 {
+		state.options().Metrics.Add(metrics.Registers, 1)
+	}
+
 	state.pub(diff)
 
-	services, err := state.index.ToMap()
-	if err != nil {
-		return nil, errors.Wrap(err, "Error rebuilding map")
-	}
+	state.apply(diff)
 
 	c, err := proto.Marshal(change)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error building change message")
 	}
 
-	state.services = services
-
 	return c, nil
 }
 
@@ -159,68 +377,235 @@ func (state *State) DeregisterAndReturnChange(s *registry.Service) ([]byte, erro
 	state.mu.Lock()
 	defer state.mu.Unlock()
 
-	diff, change, err := state.index.Remove(nil, s)
+	diff, change, err := state.index.Remove(state.context(), s)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error removing service from index")
 	}
 
+	if len(diff) != 0 {
+		state.options().Metrics.Add(metrics.Deregisters, 1)
+	}
+
 	state.pub(diff)
 
-	services, err := state.index.ToMap()
-	if err != nil {
-		return nil, errors.Wrap(err, "Error rebuilding map")
-	}
+	state.apply(diff)
 
 	c, err := proto.Marshal(change)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error building change message")
 	}
 
-	state.services = services
-
 	return c, nil
 }
 
 // Clean cleans the state
 func (state *State) Clean() error {
-	diff, err := state.index.Clean()
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	diff, err := state.index.Clean(state.context())
 	if err != nil {
 		return errors.Wrap(err, "Error cleaning state")
 	}
 
+	diff = append(state.expireStale(state.options().Clock.Now().UnixNano()), diff...)
+
+	state.compact()
+
+	state.apply(diff)
+
+	state.pub(diff)
+
+	m := state.options().Metrics
+	m.Add(metrics.Cleans, 1)
+	m.Set(metrics.Tombstones, float64(state.index.Tombstones()))
+
+	return nil
+}
+
+// DisableOwner disables all nodes owned by a member
+func (state *State) DisableOwner(owner string) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	diff, err := state.index.DisableOwner(state.context(), owner)
+	if err != nil {
+		return errors.Wrap(err, "Error disabling nodes")
+	}
+
+	state.apply(diff)
+
 	state.pub(diff)
 
 	return nil
 }
 
+// compact removes tombstones older than the retention window, the state lock
+// must be held
+func (state *State) compact() {
+	retention := state.options().TombstoneRetention
+	if retention <= 0 {
+		return
+	}
+
+	horizon := state.options().Clock.Now().Add(-retention).UnixNano()
+	if horizon <= state.horizon {
+		return
+	}
+
+	// Records of compacted nodes are kept for another retention period
+	recordHorizon := horizon - int64(retention)
+
+	state.index.Compact(horizon, recordHorizon)
+	state.horizon = horizon
+	state.recordHorizon = recordHorizon
+}
+
 func (state *State) doClean(d time.Duration) {
 	ticker := time.NewTicker(d)
-	for range ticker.C {
-		state.Clean()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			state.Clean()
+		case <-state.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the clean loop and closes all open watchers
+func (state *State) Stop() {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.stopped {
+		return
+	}
+	state.stopped = true
+
+	if state.stop != nil {
+		close(state.stop)
+	}
+
+	for _, w := range state.subs {
+		w.Stop()
 	}
 }
 
 // MergeRemote merges remote state
 func (state *State) MergeRemote(byt []byte) error {
+	_, err := state.MergeRemoteAndReturnDiff(byt)
+	return err
+}
+
+// MergeRemoteAndReturnDiff merges remote state and returns the changes it made
+func (state *State) MergeRemoteAndReturnDiff(byt []byte) ([]*Change, error) {
 	state.mu.Lock()
 	defer state.mu.Unlock()
 
+	m := state.options().Metrics
+	start := time.Now()
+
 	var index Index
 	if err := proto.Unmarshal(byt, &index); err != nil {
-		return errors.Wrap(err, "Error unmarshaling merge message")
+		m.Add(metrics.MergeErrors, 1)
+		return nil, errors.Wrap(err, "Error unmarshaling merge message")
 	}
+	index.fillMetadata()
 
-	diff, err := state.index.Merge(nil, &index)
+	state.observe(&index)
+
+	diff, err := state.index.Merge(state.context(), &index)
 	if err != nil {
-		return errors.Wrap(err, "Error merging message")
+		m.Add(metrics.MergeErrors, 1)
+		return nil, errors.Wrap(err, "Error merging message")
 	}
 
-	services, err := state.index.ToMap()
+	m.Observe(metrics.MergeDuration, time.Since(start).Seconds())
+	m.Observe(metrics.MergeDiffSize, float64(len(diff)))
+
+	state.apply(diff)
+
+	state.pub(diff)
+
+	return diff, nil
+}
+
+// LocalDigest returns the digest of the local state, from identifies this
+// member so the receiver knows where to send the delta
+func (state *State) LocalDigest(from string) ([]byte, error) {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	digest := state.index.Digest()
+	digest.From = from
+
+	buf, err := proto.Marshal(digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error marshaling digest")
+	}
+	return buf, nil
+}
+
+// Delta returns the marshaled part of the local state that differs from the
+// digest, nil is returned if nothing differs
+func (state *State) Delta(digest *Digest) ([]byte, error) {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	delta := state.index.Delta(digest)
+	if delta == nil {
+		return nil, nil
+	}
+
+	buf, err := proto.Marshal(delta)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error marshaling delta")
+	}
+	return buf, nil
+}
+
+// ParseDigest parses a remote state message as a digest, false is returned
+// if the message is a full state instead
+func ParseDigest(byt []byte) (*Digest, bool) {
+	var digest Digest
+	if err := proto.Unmarshal(byt, &digest); err != nil {
+		return nil, false
+	}
+
+	if digest.From == "" {
+		return nil, false
+	}
+
+	return &digest, true
+}
+
+// Load merges a state returned by LocalState, such as one saved to disk.
+// Loaded nodes are marked stale, they are removed from this member after the
+// stale period unless a newer copy is registered or merged, or their owner is
+// confirmed with ConfirmOwner. Stale
+// nodes are removed without a tombstone, so members that still hold them are
+// not affected
+func (state *State) Load(byt []byte, stale time.Duration) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	var index Index
+	if err := proto.Unmarshal(byt, &index); err != nil {
+		return errors.Wrap(err, "Error unmarshaling state")
+	}
+	index.fillMetadata()
+
+	state.markStale(&index, state.options().Clock.Now().Add(stale).UnixNano())
+
+	diff, err := state.index.Merge(state.context(), &index)
 	if err != nil {
-		return errors.Wrap(err, "Error rebuilding map")
+		return errors.Wrap(err, "Error merging state")
 	}
 
-	state.services = services
+	state.apply(diff)
 
 	state.pub(diff)
 
@@ -1,11 +1,14 @@
 package state
 
 import (
+	"fmt"
 	"math/rand"
 	"testing"
 	"time"
 
+	"github.com/ThatsMrTalbot/cluster/clock"
 	"github.com/micro/go-micro/registry"
+	"github.com/micro/protobuf/proto"
 	"github.com/pborman/uuid"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -52,12 +55,255 @@ func TestState(t *testing.T) {
 				So(service[0].Nodes, ShouldHaveLength, 2)
 			})
 		}))
+
+		Convey("When services change locally and remotely", func() {
+			for i := 0; i < 10; i++ {
+				So(s.Register(newService(fmt.Sprintf("test%d", i%3))), ShouldBeNil)
+			}
+
+			remote := newService("test0")
+			remote.Version = "2.0.0"
+
+			_, change, err := NewIndex().Add(nil, remote, 0)
+			So(err, ShouldBeNil)
+
+			byt, err := proto.Marshal(change)
+			So(err, ShouldBeNil)
+			So(s.MergeRemote(byt), ShouldBeNil)
+
+			list, err := s.ListServices()
+			So(err, ShouldBeNil)
+			for _, service := range list {
+				So(s.Deregister(service), ShouldBeNil)
+				break
+			}
+
+			Convey("Then the lookup map should match the index", func() {
+				m, err := s.index.ToMap()
+				So(err, ShouldBeNil)
+				So(s.services, ShouldHaveLength, len(m))
+
+				for name, services := range m {
+					So(s.services[name], ShouldHaveLength, len(services))
+
+					for _, service := range services {
+						So(s.services[name], ShouldContain, service)
+					}
+				}
+			})
+		})
 	}))
 }
 
-func WithState(f func(*State)) func() {
+func TestExpiry(t *testing.T) {
+	Convey("Given a state with a fake clock", t, func() {
+		c := clock.NewFake(time.Unix(1000, 0))
+
+		WithState(func(s *State) {
+			Convey("When a service is registered with a TTL", func() {
+				So(s.Register(newService("test"), registry.RegisterTTL(time.Minute)), ShouldBeNil)
+
+				Convey("Then it should be kept until the TTL passes", func() {
+					c.Advance(time.Second * 59)
+					So(s.Clean(), ShouldBeNil)
+
+					_, err := s.GetService("test")
+					So(err, ShouldBeNil)
+				})
+
+				Convey("Then it should be removed once the TTL passes", func() {
+					c.Advance(time.Minute * 2)
+					So(s.Clean(), ShouldBeNil)
+
+					_, err := s.GetService("test")
+					So(err, ShouldNotBeNil)
+				})
+			})
+		}, Clock(c))()
+	})
+
+	Convey("Given a state that does not clean", t, func() {
+		c := clock.NewFake(time.Unix(1000, 0))
+		s := NewState(0, Clock(c))
+		defer s.Stop()
+
+		So(s.Register(newService("test"), registry.RegisterTTL(time.Minute)), ShouldBeNil)
+
+		Convey("When the TTL passes", func() {
+			c.Advance(time.Minute * 2)
+
+			Convey("Then the service should be kept until cleaned manually", func() {
+				_, err := s.GetService("test")
+				So(err, ShouldBeNil)
+
+				So(s.Clean(), ShouldBeNil)
+
+				_, err = s.GetService("test")
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestLoad(t *testing.T) {
+	Convey("Given the state of a member", t, func() {
+		c := clock.NewFake(time.Unix(1000, 0))
+
+		WithState(func(s1 *State) {
+			service := newService("test")
+			So(s1.Register(service), ShouldBeNil)
+
+			byt, err := s1.LocalState()
+			So(err, ShouldBeNil)
+
+			Convey("When it is loaded into a new state", WithState(func(s2 *State) {
+				So(s2.Load(byt, time.Millisecond*100), ShouldBeNil)
+
+				Convey("Then the services should be available", func() {
+					services, err := s2.GetService("test")
+					So(err, ShouldBeNil)
+					So(services, ShouldHaveLength, 1)
+				})
+
+				Convey("Then the services should expire unless refreshed", func() {
+					c.Advance(time.Millisecond * 200)
+					So(s2.Clean(), ShouldBeNil)
+
+					_, err := s2.GetService("test")
+					So(err, ShouldNotBeNil)
+				})
+
+				Convey("Then expiring them should not remove them from other members", func() {
+					c.Advance(time.Millisecond * 200)
+					So(s2.Clean(), ShouldBeNil)
+					So(s2.index.Tombstones(), ShouldEqual, 0)
+
+					state, err := s2.LocalState()
+					So(err, ShouldBeNil)
+					So(s1.MergeRemote(state), ShouldBeNil)
+
+					services, err := s1.GetService("test")
+					So(err, ShouldBeNil)
+					So(services, ShouldHaveLength, 1)
+				})
+
+				Convey("Then a member sending an unchanged copy should not keep them", func() {
+					So(s2.MergeRemote(byt), ShouldBeNil)
+
+					c.Advance(time.Millisecond * 200)
+					So(s2.Clean(), ShouldBeNil)
+
+					_, err := s2.GetService("test")
+					So(err, ShouldNotBeNil)
+				})
+
+				Convey("Then a member sending a newer copy should keep them", func() {
+					So(s1.Register(service, registry.RegisterTTL(time.Hour)), ShouldBeNil)
+
+					newer, err := s1.LocalState()
+					So(err, ShouldBeNil)
+					So(s2.MergeRemote(newer), ShouldBeNil)
+
+					c.Advance(time.Millisecond * 200)
+					So(s2.Clean(), ShouldBeNil)
+
+					_, err = s2.GetService("test")
+					So(err, ShouldBeNil)
+				})
+
+				Convey("Then confirming the owner is alive should keep them", func() {
+					s2.ConfirmOwner("member1")
+
+					c.Advance(time.Millisecond * 200)
+					So(s2.Clean(), ShouldBeNil)
+
+					_, err := s2.GetService("test")
+					So(err, ShouldBeNil)
+				})
+
+				Convey("Then registering the service again should keep it", func() {
+					So(s2.Register(service), ShouldBeNil)
+
+					c.Advance(time.Millisecond * 200)
+					So(s2.Clean(), ShouldBeNil)
+
+					_, err := s2.GetService("test")
+					So(err, ShouldBeNil)
+				})
+			}, Clock(c)))
+		}, Clock(c), Owner("member1"))()
+	})
+}
+
+// benchState creates a state holding n services
+func benchState(b *testing.B, n int) *State {
+	s := NewState(time.Hour)
+
+	for i := 0; i < n; i++ {
+		if err := s.Register(newService(fmt.Sprintf("service%d", i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	return s
+}
+
+func BenchmarkRegister10k(b *testing.B) {
+	s := benchState(b, 10000)
+	defer s.Stop()
+
+	service := newService("service0")
+	for i := 0; i < b.N; i++ {
+		if err := s.Register(service); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMergeRemote10k(b *testing.B) {
+	s := benchState(b, 10000)
+	defer s.Stop()
+
+	service := newService("service0")
+	for i := 0; i < b.N; i++ {
+		_, change, err := NewIndex().Add(nil, service, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		byt, err := proto.Marshal(change)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if err := s.MergeRemote(byt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkToMap10k is the cost every change paid before the lookup map was
+// updated incrementally
+func BenchmarkToMap10k(b *testing.B) {
+	s := benchState(b, 10000)
+	defer s.Stop()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := s.index.ToMap(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func WithState(f func(*State), opts ...Option) func() {
 	return func() {
-		s := NewState(time.Second)
+		s := NewState(time.Second, opts...)
+
+		Reset(func() {
+			s.Stop()
+		})
+
 		f(s)
 	}
 }
@@ -2,29 +2,284 @@ package state
 
 import (
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/micro/go-micro/registry"
 )
 
+// OverflowPolicy decides what happens when a watchers queue is full
+type OverflowPolicy int
+
+// Overflow policies
+const (
+	// Disconnect stops the watcher, Next returns ErrWatcherOverflow once the
+	// queued results have been read
+	Disconnect OverflowPolicy = iota
+
+	// DropOldest drops the oldest queued result
+	DropOldest
+
+	// Coalesce replaces a queued result for the same service, if there is
+	// none the oldest queued result is dropped
+	Coalesce
+)
+
+// ActionSynced is the action of the result sent once a watcher created with
+// WatchSnapshot has received the current services
+const ActionSynced = "synced"
+
+var (
+	// ErrWatcherOverflow is returned by Next when the watcher fell too far behind
+	ErrWatcherOverflow = errors.New("Watcher queue overflowed")
+
+	// ErrCompacted is returned by WatchWith when the results since the
+	// requested revision are no longer held, services must be listed again
+	ErrCompacted = errors.New("Revision has been compacted")
+
+	errWatcherStopped = errors.New("Watcher has been stopped")
+)
+
+// WatchStats describes the delivery state of a watcher
+type WatchStats struct {
+	ID        string
+	Queued    int
+	Dropped   uint64
+	Delivered uint64
+
+	// Revision is the revision of the last delivered result
+	Revision uint64
+
+	// Lag is the age of the oldest queued result
+	Lag time.Duration
+}
+
+type queued struct {
+	change   *Change
+	revision uint64
+	time     time.Time
+	snapshot bool
+}
+
+// WatchSnapshot makes the watcher start with a create result for every
+// current service, followed by a result with the ActionSynced action, before
+// any live changes. Snapshot results do not count towards the queue size
+func WatchSnapshot() WatchOption {
+	return func(o *watchOptions) {
+		o.snapshot = true
+	}
+}
+
+// WatchSince makes the watcher start by replaying the results published after
+// the revision, which is usually the Revision of a previous watcher. WatchWith
+// returns ErrCompacted if those results are no longer held. Replayed results
+// do not count towards the queue size
+func WatchSince(revision uint64) WatchOption {
+	return func(o *watchOptions) {
+		o.since = &revision
+	}
+}
+
+// Watch is a watcher with its own delivery queue, publishing to it never
+// blocks
 type Watch struct {
+	id     string
 	close  chan struct{}
-	result chan *registry.Result
+	notify chan struct{}
+	filter *filter
+
+	mu        sync.Mutex
+	err       error
+	queue     []queued
+	snapshot  int
+	revision  uint64
+	size      int
+	policy    OverflowPolicy
+	dropped   uint64
+	delivered uint64
+}
+
+func newWatch(id string, size int, policy OverflowPolicy) *Watch {
+	return &Watch{
+		id:     id,
+		close:  make(chan struct{}),
+		notify: make(chan struct{}, 1),
+		size:   size,
+		policy: policy,
+	}
 }
 
+// Next blocks until a result is available
 func (w *Watch) Next() (*registry.Result, error) {
-	select {
-	case <-w.close:
-		return nil, errors.New("Watcher has been stopped")
-	case r := <-w.result:
-		return r, nil
+	c, err := w.NextChange()
+	if err != nil {
+		return nil, err
 	}
+	return c.Result, nil
 }
 
+// NextChange blocks until a change is available
+func (w *Watch) NextChange() (*Change, error) {
+	for {
+		w.mu.Lock()
+		if w.err == errWatcherStopped {
+			w.mu.Unlock()
+			return nil, w.err
+		}
+
+		if len(w.queue) != 0 {
+			q := w.queue[0]
+			w.queue[0] = queued{}
+			w.queue = w.queue[1:]
+			w.delivered++
+			w.revision = q.revision
+			if q.snapshot {
+				w.snapshot--
+			}
+			w.mu.Unlock()
+			return q.change, nil
+		}
+
+		if w.err != nil {
+			w.mu.Unlock()
+			return nil, w.err
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-w.close:
+		case <-w.notify:
+		}
+	}
+}
+
+// Stop stops the watcher
 func (w *Watch) Stop() {
-	select {
-	case <-w.close:
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stop(errWatcherStopped)
+}
+
+// Revision returns the revision of the last result returned by Next, it can
+// be passed to WatchSince to resume watching after the watcher stops
+func (w *Watch) Revision() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.revision
+}
+
+// Stats returns the delivery stats of the watcher
+func (w *Watch) Stats() WatchStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := WatchStats{
+		ID:        w.id,
+		Queued:    len(w.queue),
+		Dropped:   w.dropped,
+		Delivered: w.delivered,
+		Revision:  w.revision,
+	}
+
+	if len(w.queue) != 0 {
+		stats.Lag = time.Since(w.queue[0].time)
+	}
+
+	return stats
+}
+
+func (w *Watch) stop(err error) {
+	if w.err != nil {
 		return
+	}
+
+	w.err = err
+	close(w.close)
+}
+
+// push queues a result, true is returned if a result was dropped to make
+// room for it
+func (w *Watch) push(c *Change, rev uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return false
+	}
+
+	dropped := false
+	if w.size > 0 && len(w.queue)-w.snapshot >= w.size {
+		dropped = true
+
+		switch w.policy {
+		case Disconnect:
+			w.dropped++
+			w.stop(ErrWatcherOverflow)
+			return true
+		case Coalesce:
+			w.drop(w.indexOf(c.Service))
+		default:
+			w.drop(0)
+		}
+	}
+
+	w.queue = append(w.queue, queued{
+		change:   c,
+		revision: rev,
+		time:     time.Now(),
+	})
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+
+	return dropped
+}
+
+// preload queues snapshot or replayed results, they are queued ahead of any
+// live results and are never dropped
+func (w *Watch) preload(res []revision) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	for _, r := range res {
+		w.queue = append(w.queue, queued{
+			change:   r.change,
+			revision: r.revision,
+			time:     now,
+			snapshot: true,
+		})
+	}
+	w.snapshot += len(res)
+
+	select {
+	case w.notify <- struct{}{}:
 	default:
-		close(w.close)
 	}
 }
+
+// drop removes a queued result, the oldest live result is removed if i is -1
+func (w *Watch) drop(i int) {
+	if i == -1 {
+		i = w.snapshot
+	}
+
+	copy(w.queue[i:], w.queue[i+1:])
+	w.queue[len(w.queue)-1] = queued{}
+	w.queue = w.queue[:len(w.queue)-1]
+	w.dropped++
+}
+
+func (w *Watch) indexOf(s *registry.Service) int {
+	for i := w.snapshot; i < len(w.queue); i++ {
+		q := w.queue[i]
+		if q.change.Service.Name == s.Name && q.change.Service.Version == s.Version {
+			return i
+		}
+	}
+	return -1
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/micro/go-micro/registry"
+	"github.com/pborman/uuid"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -24,12 +25,316 @@ func TestWatch(t *testing.T) {
 
 			})
 		}))
+
+		Convey("When a node is removed", WithWatcher(s, func(w registry.Watcher) {
+			service := newService("test")
+			So(s.Register(service), ShouldBeNil)
+			So(s.Deregister(service), ShouldBeNil)
+
+			Convey("Then the change should hold the removed node", func() {
+				cw, ok := w.(ChangeWatcher)
+				So(ok, ShouldBeTrue)
+
+				_, err := cw.NextChange()
+				So(err, ShouldBeNil)
+
+				c, err := cw.NextChange()
+				So(err, ShouldBeNil)
+				So(c.Action, ShouldEqual, "delete")
+				So(c.Service.Nodes, ShouldResemble, service.Nodes)
+				So(c.Removed, ShouldResemble, service.Nodes)
+			})
+		}))
+
+		Convey("When the state is stopped", WithWatcher(s, func(w registry.Watcher) {
+			s.Stop()
+
+			Convey("Then open watchers should be closed", func() {
+				_, err := w.Next()
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Then new watchers should not be created", func() {
+				_, err := s.Watch()
+				So(err, ShouldNotBeNil)
+			})
+		}))
+	}))
+}
+
+func TestWatchOverflow(t *testing.T) {
+	Convey("Given a state with a watcher queue of two", t, func() {
+		register := func(s *State, name string) *registry.Service {
+			service := newService(name)
+			So(s.Register(service), ShouldBeNil)
+			return service
+		}
+
+		Convey("When a slow watcher uses the disconnect policy", WithState(func(s *State) {
+			WithWatcher(s, func(w registry.Watcher) {
+				done := make(chan struct{})
+				go func() {
+					for _, name := range []string{"a", "b", "c"} {
+						s.Register(newService(name))
+					}
+					close(done)
+				}()
+
+				Convey("Then registering should not block", func() {
+					So(done, ShouldBeClosedWithin, time.Second)
+				})
+
+				Convey("Then the watcher should return an overflow error once drained", func() {
+					<-done
+					So(w, ShouldHaveNext)
+					So(w, ShouldHaveNext)
+
+					_, err := w.Next()
+					So(err, ShouldEqual, ErrWatcherOverflow)
+				})
+			})()
+		}, WatchQueueSize(2), WatchOverflow(Disconnect)))
+
+		Convey("When a slow watcher uses the drop oldest policy", WithState(func(s *State) {
+			WithWatcher(s, func(w registry.Watcher) {
+				register(s, "a")
+				b := register(s, "b")
+				c := register(s, "c")
+
+				Convey("Then the newest results should be kept", func() {
+					So(w, ShouldHaveNext, &registry.Result{Action: "create", Service: b})
+					So(w, ShouldHaveNext, &registry.Result{Action: "create", Service: c})
+					So(w.(*Watch).Stats().Dropped, ShouldEqual, 1)
+				})
+			})()
+		}, WatchQueueSize(2), WatchOverflow(DropOldest)))
+
+		Convey("When a slow watcher uses the coalesce policy", WithState(func(s *State) {
+			WithWatcher(s, func(w registry.Watcher) {
+				a := register(s, "a")
+				register(s, "b")
+				a.Metadata = map[string]string{"updated": "true"}
+				So(s.Register(a), ShouldBeNil)
+
+				Convey("Then results for the same service should be replaced", func() {
+					So(w.(*Watch).Stats().Queued, ShouldEqual, 2)
+
+					r, err := w.Next()
+					So(err, ShouldBeNil)
+					So(r.Service.Name, ShouldEqual, "b")
+
+					r, err = w.Next()
+					So(err, ShouldBeNil)
+					So(r.Service.Name, ShouldEqual, "a")
+					So(r.Action, ShouldEqual, "update")
+				})
+			})()
+		}, WatchQueueSize(2), WatchOverflow(Coalesce)))
+
+		Convey("When results are queued", WithState(func(s *State) {
+			WithWatcher(s, func(w registry.Watcher) {
+				register(s, "a")
+
+				Convey("Then the lag should be reported", func() {
+					stats := s.Watchers()
+					So(stats, ShouldHaveLength, 1)
+					So(stats[0].Queued, ShouldEqual, 1)
+					So(stats[0].Lag, ShouldBeGreaterThan, 0)
+				})
+			})()
+		}, WatchQueueSize(2)))
+	})
+}
+
+func TestWatchFilter(t *testing.T) {
+	Convey("Given a state", t, WithState(func(s *State) {
+		register := func(name string, version string, metadata map[string]string) *registry.Service {
+			service := newService(name)
+			service.Version = version
+			service.Metadata = metadata
+			So(s.Register(service), ShouldBeNil)
+			return service
+		}
+
+		Convey("When a watcher filters by service name", WithWatcher(s, func(w registry.Watcher) {
+			register("a", "1.0.0", nil)
+			expected := register("b", "1.0.0", nil)
+
+			Convey("Then only results for that service should be queued", func() {
+				So(w.(*Watch).Stats().Queued, ShouldEqual, 1)
+				So(w, ShouldHaveNext, &registry.Result{Action: "create", Service: expected})
+			})
+		}, WatchServices("b", "c")))
+
+		Convey("When a watcher filters by version", WithWatcher(s, func(w registry.Watcher) {
+			register("a", "0.9.0", nil)
+			register("a", "2.0.0", nil)
+			expected := register("a", "1.4.2", nil)
+
+			Convey("Then only results for matching versions should be queued", func() {
+				So(w.(*Watch).Stats().Queued, ShouldEqual, 1)
+				So(w, ShouldHaveNext, &registry.Result{Action: "create", Service: expected})
+			})
+		}, WatchServices("a"), WatchVersion(">=1, <2")))
+
+		Convey("When a watcher filters by metadata", WithWatcher(s, func(w registry.Watcher) {
+			register("a", "1.0.0", map[string]string{"zone": "b"})
+			expected := register("b", "1.0.0", map[string]string{"zone": "a", "tier": "web"})
+
+			Convey("Then only results for matching services should be queued", func() {
+				So(w.(*Watch).Stats().Queued, ShouldEqual, 1)
+				So(w, ShouldHaveNext, &registry.Result{Action: "create", Service: expected})
+			})
+		}, WatchMetadata(map[string]string{"zone": "a"})))
+
+		Convey("When an update moves a service out of a watchers filter", WithWatcher(s, func(w registry.Watcher) {
+			service := register("a", "1.0.0", map[string]string{"zone": "a"})
+
+			moved := *service
+			moved.Metadata = map[string]string{"zone": "b"}
+			So(s.Register(&moved), ShouldBeNil)
+
+			Convey("Then the watcher should be sent a delete", func() {
+				So(w, ShouldHaveNext, &registry.Result{Action: "create", Service: service})
+				So(w, ShouldHaveNext, &registry.Result{Action: "delete", Service: service})
+			})
+
+			Convey("Then moving it back should send a create", func() {
+				So(s.Register(service), ShouldBeNil)
+
+				So(w, ShouldHaveNext, &registry.Result{Action: "create", Service: service})
+				So(w, ShouldHaveNext, &registry.Result{Action: "delete", Service: service})
+				So(w, ShouldHaveNext, &registry.Result{Action: "create", Service: service})
+			})
+		}, WatchMetadata(map[string]string{"zone": "a"})))
+
+		Convey("When a watcher has an invalid version constraint", func() {
+			_, err := s.WatchWith(WatchVersion(">=1,"))
+
+			Convey("Then an error should be returned", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
 	}))
 }
 
-func WithWatcher(s *State, f func(registry.Watcher)) func() {
+func TestWatchSnapshot(t *testing.T) {
+	Convey("Given a state with registered services", t, WithState(func(s *State) {
+		a := newService("a")
+		b := newService("b")
+		So(s.Register(a), ShouldBeNil)
+		So(s.Register(b), ShouldBeNil)
+
+		Convey("When a snapshot watcher is created", WithWatcher(s, func(w registry.Watcher) {
+			c := newService("c")
+			So(s.Register(c), ShouldBeNil)
+
+			Convey("Then the current services should be replayed before live changes", func() {
+				seen := make(map[string]bool)
+				for i := 0; i < 2; i++ {
+					r, err := w.Next()
+					So(err, ShouldBeNil)
+					So(r.Action, ShouldEqual, "create")
+					seen[r.Service.Name] = true
+				}
+				So(seen, ShouldResemble, map[string]bool{"a": true, "b": true})
+
+				r, err := w.Next()
+				So(err, ShouldBeNil)
+				So(r.Action, ShouldEqual, ActionSynced)
+
+				So(w, ShouldHaveNext, &registry.Result{Action: "create", Service: c})
+			})
+		}, WatchSnapshot()))
+
+		Convey("When a filtered snapshot watcher has a small queue", func() {
+			WithWatcher(s, func(w registry.Watcher) {
+				So(s.Register(newService("b")), ShouldBeNil)
+
+				Convey("Then the snapshot should not count towards the queue size", func() {
+					So(w, ShouldHaveNext, &registry.Result{Action: "create", Service: b})
+
+					r, err := w.Next()
+					So(err, ShouldBeNil)
+					So(r.Action, ShouldEqual, ActionSynced)
+
+					r, err = w.Next()
+					So(err, ShouldBeNil)
+					So(r.Action, ShouldEqual, "update")
+				})
+			}, WatchSnapshot(), WatchServices("b"))()
+		})
+	}, WatchQueueSize(1)))
+}
+
+func TestWatchSince(t *testing.T) {
+	Convey("Given a state with a stopped watcher", t, WithState(func(s *State) {
+		a := newService("a")
+		b := newService("b")
+
+		w, err := s.Watch()
+		So(err, ShouldBeNil)
+
+		So(s.Register(a), ShouldBeNil)
+		So(w, ShouldHaveNext, &registry.Result{Action: "create", Service: a})
+		w.Stop()
+
+		revision := w.(*Watch).Revision()
+		So(revision, ShouldBeGreaterThan, 0)
+
+		So(s.Register(b), ShouldBeNil)
+
+		Convey("When a watcher resumes from its revision", WithWatcher(s, func(w registry.Watcher) {
+			Convey("Then the missed results should be replayed", func() {
+				So(w, ShouldHaveNext, &registry.Result{Action: "create", Service: b})
+				So(w.(*Watch).Revision(), ShouldEqual, revision+1)
+			})
+		}, WatchSince(revision)))
+
+		Convey("When a watcher resumes from a revision that is not held", func() {
+			for _, name := range []string{"c", "d"} {
+				So(s.Register(newService(name)), ShouldBeNil)
+			}
+
+			_, err := s.WatchWith(WatchSince(revision))
+
+			Convey("Then ErrCompacted should be returned", func() {
+				So(err, ShouldEqual, ErrCompacted)
+			})
+		})
+
+		Convey("When a watcher resumes from a revision from the future", func() {
+			_, err := s.WatchWith(WatchSince(revision + 100))
+
+			Convey("Then ErrCompacted should be returned", func() {
+				So(err, ShouldEqual, ErrCompacted)
+			})
+		})
+	}, HistorySize(2)))
+}
+
+func newService(name string) *registry.Service {
+	return &registry.Service{
+		Name:    name,
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{Id: uuid.NewUUID().String(), Address: "127.0.0.1", Port: 80},
+		},
+	}
+}
+
+func ShouldBeClosedWithin(actual interface{}, expected ...interface{}) string {
+	select {
+	case <-actual.(chan struct{}):
+		return ""
+	case <-time.After(expected[0].(time.Duration)):
+		return "Channel was not closed in time"
+	}
+}
+
+func WithWatcher(s *State, f func(registry.Watcher), opts ...WatchOption) func() {
 	return func() {
-		watcher, err := s.Watch()
+		watcher, err := s.WatchWith(opts...)
 		So(err, ShouldBeNil)
 
 		Reset(func() {
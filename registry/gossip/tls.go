@@ -0,0 +1,509 @@
+package gossip
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/logger"
+	"github.com/hashicorp/memberlist"
+	"github.com/pkg/errors"
+)
+
+// Connection types sent by the dialing side of a TLS connection
+const (
+	tlsStreamConn byte = 'S'
+	tlsPacketConn byte = 'P'
+)
+
+var (
+	// TLSTimeout is the time allowed to dial a peer, complete the TLS
+	// handshake or write a packet
+	TLSTimeout = time.Second * 10
+
+	// maxTLSPacket is the largest packet accepted from a peer
+	maxTLSPacket = 1 << 20
+
+	// tlsPacketQueue is the number of packets queued for a peer while it is
+	// dialed or written to, packets are dropped once it is full
+	tlsPacketQueue = 64
+)
+
+// tlsTransport is a memberlist transport that sends all traffic over TLS
+// connections. Packets, which carry probes and piggybacked broadcasts, are
+// framed over a long lived connection per peer instead of UDP, so every
+// message comes from a peer whose certificate was verified
+type tlsTransport struct {
+	server   *tls.Config
+	client   *tls.Config
+	listener net.Listener
+	log      logger.Logger
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+	done     chan struct{}
+
+	mu        sync.Mutex
+	advertise string
+	conns     map[string]*tlsPacketWriter
+	inbound   map[net.Conn]struct{}
+	shutdown  bool
+}
+
+// tlsPacketWriter queues packets for a peer, they are written by its own
+// goroutine so a slow or unreachable peer never blocks memberlist
+type tlsPacketWriter struct {
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+}
+
+// newTLSTransport listens for TLS connections on the address. Peers must
+// present a certificate signed by config.ClientCAs, or config.RootCAs if it is
+// not set, unless config.ClientAuth is set. One of them must be set, peers are
+// never verified against the system roots
+func newTLSTransport(addr string, port int, config *tls.Config, log logger.Logger) (*tlsTransport, error) {
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return nil, errors.New("TLS config has no certificate")
+	}
+
+	if config.RootCAs == nil && config.ClientCAs == nil {
+		return nil, errors.New("TLS config has no CA, set RootCAs or ClientCAs")
+	}
+
+	server, client := tlsConfigs(config)
+
+	listener, err := tls.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(port)), server)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listening for TLS connections")
+	}
+
+	t := &tlsTransport{
+		server:   server,
+		client:   client,
+		listener: listener,
+		log:      log,
+		packetCh: make(chan *memberlist.Packet),
+		streamCh: make(chan net.Conn),
+		done:     make(chan struct{}),
+		conns:    make(map[string]*tlsPacketWriter),
+		inbound:  make(map[net.Conn]struct{}),
+	}
+
+	go t.accept()
+	return t, nil
+}
+
+// tlsConfigs builds the server and client configs, the fields are copied as
+// the config may not be copied once used
+func tlsConfigs(config *tls.Config) (*tls.Config, *tls.Config) {
+	server := &tls.Config{
+		Certificates:   config.Certificates,
+		GetCertificate: config.GetCertificate,
+		RootCAs:        config.RootCAs,
+		ClientCAs:      config.ClientCAs,
+		ClientAuth:     config.ClientAuth,
+		CipherSuites:   config.CipherSuites,
+		MinVersion:     config.MinVersion,
+		MaxVersion:     config.MaxVersion,
+	}
+
+	if server.ClientAuth == tls.NoClientCert {
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if server.ClientCAs == nil {
+		server.ClientCAs = config.RootCAs
+	}
+
+	roots := config.RootCAs
+	if roots == nil {
+		roots = config.ClientCAs
+	}
+
+	// Peers are dialed by address, which their certificates are unlikely to
+	// name, so the chain is verified against the CA without a host name
+	// unless a server name is configured
+	client := &tls.Config{
+		Certificates:       config.Certificates,
+		RootCAs:            roots,
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.ServerName == "",
+		CipherSuites:       config.CipherSuites,
+		MinVersion:         config.MinVersion,
+		MaxVersion:         config.MaxVersion,
+	}
+
+	return server, client
+}
+
+func (t *tlsTransport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	bound := t.listener.Addr().(*net.TCPAddr)
+	if port == 0 {
+		port = bound.Port
+	}
+
+	var advertise net.IP
+	if ip != "" {
+		advertise = net.ParseIP(ip)
+		if advertise == nil {
+			return nil, 0, errors.Errorf("Failed to parse advertise address %q", ip)
+		}
+	} else if !bound.IP.IsUnspecified() {
+		advertise = bound.IP
+	} else {
+		var err error
+		if advertise, err = privateIP(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if v4 := advertise.To4(); v4 != nil {
+		advertise = v4
+	}
+
+	t.mu.Lock()
+	t.advertise = net.JoinHostPort(advertise.String(), strconv.Itoa(port))
+	t.mu.Unlock()
+
+	return advertise, port, nil
+}
+
+// privateIP returns the first non loopback IPv4 address of the host
+func privateIP() (net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting interface addresses")
+	}
+
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+			return n.IP.To4(), nil
+		}
+	}
+	return nil, errors.New("No address to advertise, set one with Advertise")
+}
+
+// WriteTo queues the packet for the peer and returns without waiting for it
+// to be dialed or written, like a UDP write the packet may still be lost
+func (t *tlsTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	w, err := t.packetWriter(addr)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	select {
+	case w.queue <- b:
+	default:
+		return time.Time{}, errors.Errorf("Packet queue to %s is full", addr)
+	}
+
+	return time.Now(), nil
+}
+
+func (t *tlsTransport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+func (t *tlsTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return t.dial(addr, timeout, []byte{tlsStreamConn})
+}
+
+func (t *tlsTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+func (t *tlsTransport) Shutdown() error {
+	t.mu.Lock()
+	if !t.shutdown {
+		t.shutdown = true
+		close(t.done)
+	}
+	for addr, w := range t.conns {
+		w.stop()
+		delete(t.conns, addr)
+	}
+	for conn := range t.inbound {
+		conn.Close()
+		delete(t.inbound, conn)
+	}
+	t.mu.Unlock()
+
+	return t.listener.Close()
+}
+
+func (t *tlsTransport) isShutdown() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.shutdown
+}
+
+// dial connects to a peer, verifies its certificate and writes the preamble
+func (t *tlsTransport) dial(addr string, timeout time.Duration, preamble []byte) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, t.client)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error dialing %s", addr)
+	}
+
+	if t.client.InsecureSkipVerify {
+		if err := verifyChain(conn, t.client.RootCAs); err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "Error verifying certificate of %s", addr)
+		}
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(preamble); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "Error writing to %s", addr)
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// verifyChain verifies the peer certificate chain against the roots without
+// checking the host name
+func verifyChain(conn *tls.Conn, roots *x509.CertPool) error {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("Peer presented no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// packetWriter returns the packet writer of a peer, starting one if needed
+func (t *tlsTransport) packetWriter(addr string) (*tlsPacketWriter, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.shutdown {
+		return nil, errors.New("Transport has been shut down")
+	}
+	if w, ok := t.conns[addr]; ok {
+		return w, nil
+	}
+
+	w := &tlsPacketWriter{
+		queue: make(chan []byte, tlsPacketQueue),
+		done:  make(chan struct{}),
+	}
+	t.conns[addr] = w
+
+	go t.writePackets(addr, w, t.advertise)
+	return w, nil
+}
+
+// writePackets dials the peer and writes queued packets until the writer is
+// stopped or a write fails. The preamble holds our advertised address,
+// replies are sent to the address a packet came from
+func (t *tlsTransport) writePackets(addr string, w *tlsPacketWriter, advertise string) {
+	defer t.dropPacketWriter(addr, w)
+
+	preamble := []byte{tlsPacketConn}
+	preamble = appendFrame(preamble, []byte(advertise))
+
+	conn, err := t.dial(addr, TLSTimeout, preamble)
+	if err != nil {
+		t.log.Log(logger.DebugLevel, "Error dialing TLS packet connection", logger.Fields{"remote": addr, "error": err})
+		return
+	}
+	defer conn.Close()
+
+	for {
+		select {
+		case b := <-w.queue:
+			conn.SetWriteDeadline(time.Now().Add(TLSTimeout))
+			if _, err := conn.Write(appendFrame(nil, b)); err != nil {
+				t.log.Log(logger.DebugLevel, "Error writing TLS packet", logger.Fields{"remote": addr, "error": err})
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// dropPacketWriter stops the writer, the next packet to the peer starts a new
+// one
+func (t *tlsTransport) dropPacketWriter(addr string, w *tlsPacketWriter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns[addr] == w {
+		delete(t.conns, addr)
+	}
+	w.stop()
+}
+
+func (w *tlsPacketWriter) stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+func appendFrame(buf []byte, b []byte) []byte {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(b)))
+	return append(append(buf, size[:]...), b...)
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n > uint32(maxTLSPacket) {
+		return nil, errors.Errorf("Packet of %d bytes is too large", n)
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (t *tlsTransport) accept() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if t.isShutdown() {
+				return
+			}
+
+			t.log.Log(logger.ErrorLevel, "Error accepting TLS connection", logger.Fields{"error": err})
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+
+		go t.handle(conn)
+	}
+}
+
+// track records an inbound connection so Shutdown can close it, false is
+// returned if the transport has been shut down
+func (t *tlsTransport) track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.shutdown {
+		return false
+	}
+	t.inbound[conn] = struct{}{}
+	return true
+}
+
+func (t *tlsTransport) untrack(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.inbound, conn)
+}
+
+// handle completes the handshake and reads the connection type, stream
+// connections are passed to memberlist and packets are read until the
+// connection is closed
+func (t *tlsTransport) handle(conn net.Conn) {
+	if !t.track(conn) {
+		conn.Close()
+		return
+	}
+	defer t.untrack(conn)
+
+	conn.SetReadDeadline(time.Now().Add(TLSTimeout))
+
+	r := bufio.NewReader(conn)
+	kind, err := r.ReadByte()
+	if err != nil {
+		t.log.Log(logger.WarnLevel, "Error reading TLS connection", logger.Fields{"remote": conn.RemoteAddr().String(), "error": err})
+		conn.Close()
+		return
+	}
+
+	switch kind {
+	case tlsStreamConn:
+		conn.SetReadDeadline(time.Time{})
+
+		select {
+		case t.streamCh <- &bufferedConn{Conn: conn, r: r}:
+		case <-t.done:
+			conn.Close()
+		}
+	case tlsPacketConn:
+		t.readPackets(conn, r)
+	default:
+		t.log.Log(logger.WarnLevel, "Unknown TLS connection type", logger.Fields{"remote": conn.RemoteAddr().String()})
+		conn.Close()
+	}
+}
+
+func (t *tlsTransport) readPackets(conn net.Conn, r *bufio.Reader) {
+	defer conn.Close()
+
+	advertise, err := readFrame(r)
+	if err != nil {
+		t.log.Log(logger.WarnLevel, "Error reading TLS packet preamble", logger.Fields{"remote": conn.RemoteAddr().String(), "error": err})
+		return
+	}
+
+	from, err := net.ResolveTCPAddr("tcp", string(advertise))
+	if err != nil {
+		t.log.Log(logger.WarnLevel, "Invalid TLS packet address", logger.Fields{"remote": conn.RemoteAddr().String(), "error": err})
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	for {
+		buf, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF && !t.isShutdown() {
+				t.log.Log(logger.DebugLevel, "TLS packet connection closed", logger.Fields{"remote": from.String(), "error": err})
+			}
+			return
+		}
+
+		packet := &memberlist.Packet{
+			Buf:       buf,
+			From:      from,
+			Timestamp: time.Now(),
+		}
+
+		select {
+		case t.packetCh <- packet:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// bufferedConn reads through the reader used to read the connection type
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,190 @@
+package gossip
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/logger"
+	"github.com/hashicorp/memberlist"
+	"github.com/micro/go-micro/registry"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTLS(t *testing.T) {
+	Convey("Given a registry using TLS", t, func() {
+		ca := newTestCA()
+
+		WithRegistry(nil, func(r1 registry.Registry, addr string, port int) {
+			r1Address := fmt.Sprintf("%s:%d", addr, port)
+
+			Convey("When a registry with a certificate from the same CA joins", WithRegistry([]string{r1Address}, func(r2 registry.Registry, addr string, port int) {
+				Convey("Then services should propagate", WithService(r1, "test", addr, port, func(*registry.Service) {
+					time.Sleep(time.Second)
+
+					service, err := r2.GetService("test")
+					So(err, ShouldBeNil)
+					So(service, ShouldHaveLength, 1)
+					So(r2.(Inspector).Members(), ShouldHaveLength, 2)
+				}))
+			}, registry.TLSConfig(ca.config())))
+
+			Convey("When a registry with a certificate from another CA joins", WithRegistry([]string{r1Address}, func(r2 registry.Registry, addr string, port int) {
+				Convey("Then services should not propagate", WithService(r1, "test", addr, port, func(*registry.Service) {
+					time.Sleep(time.Second)
+
+					_, err := r2.GetService("test")
+					So(err, ShouldNotBeNil)
+					So(r1.(Inspector).Members(), ShouldHaveLength, 1)
+				}))
+			}, registry.TLSConfig(newTestCA().config()), JoinRetry(time.Millisecond*100, time.Millisecond*100)))
+		}, registry.TLSConfig(ca.config()))()
+	})
+
+	Convey("Given a TLS config without a CA", t, func() {
+		config := newTestCA().config()
+		config.RootCAs = nil
+
+		_, err := New(Address("127.0.0.1:0"), registry.TLSConfig(config))
+
+		Convey("Then an option error should be returned", func() {
+			So(err, ShouldHaveSameTypeAs, &OptionError{})
+			So(err.(*OptionError).Option, ShouldEqual, "TLSConfig")
+		})
+	})
+
+	Convey("Given a TLS config without a certificate", t, func() {
+		_, err := New(Address("127.0.0.1:0"), registry.TLSConfig(&tls.Config{}))
+
+		Convey("Then an option error should be returned", func() {
+			So(err, ShouldHaveSameTypeAs, &OptionError{})
+			So(err.(*OptionError).Option, ShouldEqual, "TLSConfig")
+		})
+	})
+}
+
+func TestTLSTransport(t *testing.T) {
+	Convey("Given two TLS transports", t, func() {
+		ca := newTestCA()
+
+		t1, err := newTLSTransport("127.0.0.1", 0, ca.config(), logger.Nop)
+		So(err, ShouldBeNil)
+		t2, err := newTLSTransport("127.0.0.1", 0, ca.config(), logger.Nop)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			t1.Shutdown()
+			t2.Shutdown()
+		})
+
+		_, _, err = t1.FinalAdvertiseAddr("127.0.0.1", 0)
+		So(err, ShouldBeNil)
+		ip, port, err := t2.FinalAdvertiseAddr("127.0.0.1", 0)
+		So(err, ShouldBeNil)
+
+		Convey("When a packet is written to a peer that is not listening", func() {
+			start := time.Now()
+			_, err := t1.WriteTo([]byte("packet"), "10.255.255.1:7946")
+
+			Convey("Then the write should not wait for the dial", func() {
+				So(err, ShouldBeNil)
+				So(time.Since(start), ShouldBeLessThan, time.Second)
+			})
+		})
+
+		Convey("When a packet is written to the other transport", func() {
+			_, err := t1.WriteTo([]byte("packet"), net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+			So(err, ShouldBeNil)
+
+			var packet *memberlist.Packet
+			select {
+			case packet = <-t2.PacketCh():
+			case <-time.After(time.Second * 5):
+			}
+
+			Convey("Then it should be received", func() {
+				So(packet, ShouldNotBeNil)
+				So(string(packet.Buf), ShouldEqual, "packet")
+			})
+
+			Convey("Then shutting down should close the inbound connection", func() {
+				t2.mu.Lock()
+				So(t2.inbound, ShouldHaveLength, 1)
+				t2.mu.Unlock()
+
+				So(t2.Shutdown(), ShouldBeNil)
+
+				t2.mu.Lock()
+				So(t2.inbound, ShouldBeEmpty)
+				t2.mu.Unlock()
+			})
+		})
+	})
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA() *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	So(err, ShouldBeNil)
+
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+
+	return &testCA{cert: cert, key: key}
+}
+
+// config returns a TLS config with a certificate signed by the CA
+func (ca *testCA) config() *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "member"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	So(err, ShouldBeNil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}},
+		RootCAs: pool,
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ThatsMrTalbot/cluster/registry/gossip/state"
 	"github.com/micro/go-micro/registry"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -24,6 +25,26 @@ func TestWatch(t *testing.T) {
 			}))
 		}))
 
+		Convey("When a filtered watcher is initiated", func() {
+			w, err := r1.(Registry).WatchWith(state.WatchServices("test"))
+			So(err, ShouldBeNil)
+
+			Reset(func() {
+				w.Stop()
+			})
+
+			WithService(r1, "other", addr, port, nil)()
+
+			Convey("Then only matching changes should be published to the watcher", WithService(r1, "test", addr, port, func(s *registry.Service) {
+				expected := &registry.Result{
+					Action:  "create",
+					Service: s,
+				}
+
+				So(w, ShouldHaveNext, expected)
+			}))
+		})
+
 		Convey("When a watcher is initiated from a joined node", WithRegistry([]string{r1Address}, func(r2 registry.Registry, _ string, _ int) {
 			WithWatcher(r2, func(w registry.Watcher) {
 				Convey("Then changes should be published to the watcher", WithService(r1, "test", addr, port, func(s *registry.Service) {
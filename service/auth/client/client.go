@@ -68,7 +68,7 @@ func (c *Client) Validate(token string) (*proto.Token, error) {
 		return nil, errors.New("Refresh tokens cannot be validated")
 	}
 
-	if expired(data) {
+	if expired(data, c.opts.Clock) {
 		return nil, errors.New("Token has expired")
 	}
 
@@ -3,9 +3,11 @@ package client
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/ThatsMrTalbot/cluster/clock"
 	"github.com/ThatsMrTalbot/cluster/service/auth/proto"
 	"github.com/ThatsMrTalbot/prototoken"
 	"github.com/micro/go-micro/client/mock"
@@ -123,6 +125,40 @@ func TestClient(t *testing.T) {
 	}))
 }
 
+func TestExpiry(t *testing.T) {
+	Convey("Given a client with a fake clock", t, func() {
+		c := clock.NewFake(time.Unix(1000, 0))
+		client := NewClient(mock.NewClient(), "service", Clock(c))
+
+		token := &proto.Token{
+			Type:   proto.TokenType_Auth,
+			User:   &proto.User{UID: "test"},
+			Expiry: c.Now().Add(time.Minute).Unix(),
+		}
+
+		str, err := prototoken.GenerateString(token, prototoken.NewHMACPrivateKey([]byte("DefaultSecret")))
+		So(err, ShouldBeNil)
+
+		Convey("When the token is validated before it expires", func() {
+			c.Advance(time.Second * 30)
+			_, err := client.Validate(str)
+
+			Convey("Then the token should be validated", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When the token is validated after it expires", func() {
+			c.Advance(time.Minute * 2)
+			_, err := client.Validate(str)
+
+			Convey("Then an error should be returned", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
 func WithValidClient(f func(*Client)) func() {
 	return func() {
 		client := mock.NewClient(
@@ -3,6 +3,7 @@ package client
 import (
 	"crypto/rsa"
 
+	"github.com/ThatsMrTalbot/cluster/clock"
 	"github.com/ThatsMrTalbot/prototoken"
 )
 
@@ -13,11 +14,13 @@ var (
 
 type options struct {
 	PublicKey prototoken.PublicKey
+	Clock     clock.Clock
 }
 
 func parse(opts ...Option) *options {
 	options := &options{
 		PublicKey: DefaultPublicKey,
+		Clock:     clock.System,
 	}
 
 	for _, o := range opts {
@@ -43,3 +46,10 @@ func PublicKeyRSA(key *rsa.PublicKey) Option {
 		o.PublicKey = prototoken.NewRSAPublicKey(key)
 	}
 }
+
+// Clock sets the clock token expiry is checked against
+func Clock(c clock.Clock) Option {
+	return func(o *options) {
+		o.Clock = c
+	}
+}
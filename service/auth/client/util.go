@@ -1,14 +1,13 @@
 package client
 
 import (
-	"time"
-
+	"github.com/ThatsMrTalbot/cluster/clock"
 	"github.com/ThatsMrTalbot/cluster/service/auth/proto"
 	"github.com/ThatsMrTalbot/prototoken"
 	"github.com/pkg/errors"
 )
 
-// Expired checks if token has expired
+// Expired checks if token has expired by the system clock
 func Expired(token string) (bool, error) {
 	tok, err := prototoken.UnpackString(token)
 	if err != nil {
@@ -21,11 +20,11 @@ func Expired(token string) (bool, error) {
 		return false, errors.Wrap(err, "Could not extract value")
 	}
 
-	return expired(&value), nil
+	return expired(&value, clock.System), nil
 }
 
-func expired(token *proto.Token) bool {
-	return token.Expiry != 0 && token.Expiry < time.Now().UTC().Unix()
+func expired(token *proto.Token, c clock.Clock) bool {
+	return token.Expiry != 0 && token.Expiry < c.Now().UTC().Unix()
 }
 
 // HasPermission returns true if the user has a permission
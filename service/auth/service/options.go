@@ -4,6 +4,7 @@ import (
 	"crypto/rsa"
 	"time"
 
+	"github.com/ThatsMrTalbot/cluster/clock"
 	"github.com/ThatsMrTalbot/prototoken"
 )
 
@@ -29,15 +30,19 @@ type options struct {
 	RefreshPrivateKey prototoken.PrivateKey
 	RefreshPublicKey  prototoken.PublicKey
 	RefreshExpiry     time.Duration
+
+	Clock clock.Clock
 }
 
 func parse(opts ...Option) *options {
 	options := &options{
 		TokenExpiry:       DefaultTokenExpiry,
+		RefreshExpiry:     DefaultRefreshExpiry,
 		TokenPublicKey:    DefaultPublicKey,
 		TokenPrivateKey:   DefaultPrivateKey,
 		RefreshPublicKey:  DefaultPublicKey,
 		RefreshPrivateKey: DefaultPrivateKey,
+		Clock:             clock.System,
 	}
 
 	for _, o := range opts {
@@ -150,3 +155,10 @@ func RefreshTokenExpiry(d time.Duration) Option {
 		o.RefreshExpiry = d
 	}
 }
+
+// Clock sets the clock token expiry is read from
+func Clock(c clock.Clock) Option {
+	return func(o *options) {
+		o.Clock = c
+	}
+}
@@ -82,6 +82,8 @@ func TestOptionParse(t *testing.T) {
 
 				So(opts2.TokenPublicKey, ShouldEqual, opts2.RefreshPublicKey)
 				So(opts2.TokenPrivateKey, ShouldEqual, opts2.RefreshPrivateKey)
+				So(opts2.TokenExpiry, ShouldEqual, DefaultTokenExpiry)
+				So(opts2.RefreshExpiry, ShouldEqual, DefaultRefreshExpiry)
 
 				//--
 
@@ -1,8 +1,6 @@
 package service
 
 import (
-	"time"
-
 	"github.com/ThatsMrTalbot/cluster/service/auth/proto"
 	"github.com/ThatsMrTalbot/prototoken"
 	"github.com/micro/go-micro/server"
@@ -60,7 +58,7 @@ func (a *Auth) Refresh(ctx context.Context, req *proto.RefreshRequest, rsp *prot
 		return errors.New("Provided token is not a refresh token")
 	}
 
-	if tok.Expiry < time.Now().UTC().Unix() {
+	if tok.Expiry != 0 && tok.Expiry < a.opts.Clock.Now().UTC().Unix() {
 		return errors.New("Provided token has expired")
 	}
 
@@ -75,7 +73,7 @@ func (a *Auth) Refresh(ctx context.Context, req *proto.RefreshRequest, rsp *prot
 func (a *Auth) generate(user *proto.User) (string, string, error) {
 	tokenExp := int64(0)
 	if a.opts.TokenExpiry > 0 {
-		tokenExp = time.Now().UTC().Add(a.opts.TokenExpiry).Unix()
+		tokenExp = a.opts.Clock.Now().UTC().Add(a.opts.TokenExpiry).Unix()
 	}
 
 	token := &proto.Token{
@@ -85,8 +83,8 @@ func (a *Auth) generate(user *proto.User) (string, string, error) {
 	}
 
 	refreshExp := int64(0)
-	if a.opts.TokenExpiry > 0 {
-		refreshExp = time.Now().UTC().Add(a.opts.RefreshExpiry).Unix()
+	if a.opts.RefreshExpiry > 0 {
+		refreshExp = a.opts.Clock.Now().UTC().Add(a.opts.RefreshExpiry).Unix()
 	}
 
 	refresh := &proto.Token{
@@ -3,9 +3,11 @@ package service
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/ThatsMrTalbot/cluster/clock"
 	"github.com/ThatsMrTalbot/cluster/service/auth/proto"
 	"github.com/micro/go-micro/server/mock"
 	. "github.com/smartystreets/goconvey/convey"
@@ -100,6 +102,101 @@ func TestAuth(t *testing.T) {
 	})
 }
 
+func TestExpiry(t *testing.T) {
+	Convey("Given a service with a fake clock", t, func() {
+		c := clock.NewFake(time.Unix(1000, 0))
+		auth := &Auth{
+			opts:  parse(Clock(c)),
+			iface: DummyInterface{},
+		}
+
+		_, token, err := auth.generate(&proto.User{})
+		So(err, ShouldBeNil)
+
+		req := &proto.RefreshRequest{
+			Token: token,
+		}
+
+		Convey("When refresh is called before the refresh token expires", func() {
+			c.Advance(DefaultRefreshExpiry - time.Minute)
+
+			rsp := &proto.Response{}
+			err := auth.Refresh(context.TODO(), req, rsp)
+
+			Convey("Then the result should contain a token", func() {
+				So(err, ShouldBeNil)
+				So(rsp.Token, ShouldNotBeEmpty)
+			})
+		})
+
+		Convey("When refresh is called after the refresh token expires", func() {
+			c.Advance(DefaultRefreshExpiry + time.Minute)
+
+			rsp := &proto.Response{}
+			err := auth.Refresh(context.TODO(), req, rsp)
+
+			Convey("Then an error should be returned", func() {
+				So(err, ShouldNotBeNil)
+				So(rsp.Token, ShouldBeEmpty)
+			})
+		})
+	})
+
+	Convey("Given a service with tokens that never expire", t, func() {
+		c := clock.NewFake(time.Unix(1000, 0))
+		auth := &Auth{
+			opts:  parse(Clock(c), TokenExpiry(0)),
+			iface: DummyInterface{},
+		}
+
+		_, token, err := auth.generate(&proto.User{})
+		So(err, ShouldBeNil)
+
+		req := &proto.RefreshRequest{
+			Token: token,
+		}
+
+		Convey("When refresh is called after the refresh token expires", func() {
+			c.Advance(DefaultRefreshExpiry + time.Minute)
+
+			rsp := &proto.Response{}
+			err := auth.Refresh(context.TODO(), req, rsp)
+
+			Convey("Then an error should be returned", func() {
+				So(err, ShouldNotBeNil)
+				So(rsp.Token, ShouldBeEmpty)
+			})
+		})
+	})
+
+	Convey("Given a service with refresh tokens that never expire", t, func() {
+		c := clock.NewFake(time.Unix(1000, 0))
+		auth := &Auth{
+			opts:  parse(Clock(c), RefreshTokenExpiry(0)),
+			iface: DummyInterface{},
+		}
+
+		_, token, err := auth.generate(&proto.User{})
+		So(err, ShouldBeNil)
+
+		req := &proto.RefreshRequest{
+			Token: token,
+		}
+
+		Convey("When refresh is called long after the default expiry", func() {
+			c.Advance(DefaultRefreshExpiry * 100)
+
+			rsp := &proto.Response{}
+			err := auth.Refresh(context.TODO(), req, rsp)
+
+			Convey("Then the result should contain a token", func() {
+				So(err, ShouldBeNil)
+				So(rsp.Token, ShouldNotBeEmpty)
+			})
+		})
+	})
+}
+
 type DummyInterface struct{}
 
 func (DummyInterface) Auth(u string, p string) (*proto.User, error) {